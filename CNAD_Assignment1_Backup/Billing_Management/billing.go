@@ -3,9 +3,12 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -14,25 +17,47 @@ import (
 )
 
 type Billing struct {
-	ID            int     `json:"id"`
-	ReservationID int     `json:"reservation_id"`
-	Amount        float64 `json:"amount"`
-	PaymentStatus string  `json:"payment_status"`
+	ID              int    `json:"id"`
+	ReservationID   int    `json:"reservation_id"`
+	UserID          int    `json:"user_id"`
+	Amount          Money  `json:"amount"`     // total due, including tax
+	TaxAmount       Money  `json:"tax_amount"` // tax included in Amount
+	TaxInclusive    bool   `json:"tax_inclusive"`
+	PaymentStatus   string `json:"payment_status"`
+	CancellationFee *Money `json:"cancellation_fee,omitempty"` // set once a cancellation has been settled
+	OvertimeFee     *Money `json:"overtime_fee,omitempty"`     // late return charge before tax, set once the return has been assessed
+	OvertimeMinutes int    `json:"overtime_minutes,omitempty"`
 }
 
-type Invoice struct {
-	InvoiceID     int       `json:"invoice_id"`
-	BillingID     int       `json:"billing_id"`
-	ReservationID int       `json:"reservation_id"`
-	Amount        float64   `json:"amount"`
-	GeneratedDate time.Time `json:"generated_date"`
-}
+// Layout of DATETIME columns, since the connections do not set parseTime
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+const billingColumns = "id, reservation_id, user_id, currency, amount, tax_amount, tax_inclusive, payment_status, cancellation_fee, overtime_fee, COALESCE(overtime_minutes, 0)"
+
+// Values of billings.payment_status
+const (
+	billingPending           = "Pending"
+	billingPaid              = "Paid"
+	billingPartiallyRefunded = "PartiallyRefunded"
+	billingRefunded          = "Refunded"
+	billingVoid              = "Void" // cancelled before payment with no fee due
+)
+
+var (
+	errBillingExists        = errors.New("reservation has already been billed")
+	errReservationCancelled = errors.New("reservation has been cancelled")
+	errReservationPending   = errors.New("reservation is waiting for its deposit to be confirmed")
+)
 
 type Receipt struct {
-	ReceiptID   int       `json:"receipt_id"`
-	BillingID   int       `json:"billing_id"`
-	Amount      float64   `json:"amount"`
-	PaymentDate time.Time `json:"payment_date"`
+	ReceiptID        int       `json:"receipt_id"`
+	BillingID        int       `json:"billing_id"`
+	Amount           Money     `json:"amount"`
+	TaxAmount        Money     `json:"tax_amount"`
+	PaymentDate      time.Time `json:"payment_date"`
+	PaymentReference string    `json:"payment_reference"`
+	PaymentMethod    string    `json:"payment_method"`
+	CardLast4        string    `json:"card_last4,omitempty"`
 }
 
 var vehicleDB *sql.DB
@@ -71,14 +96,15 @@ func initDB() {
 	fmt.Println("Connected to all databases.")
 }
 
-func generateInvoice(w http.ResponseWriter, r *http.Request) {
+func generateReceipt(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	billingID := params["billing_id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
 
-	// Get the billing details from the billing database
-	var billing Billing
-	err := billingDB.QueryRow("SELECT id, reservation_id, amount, payment_status FROM billings WHERE id = ?", billingID).
-		Scan(&billing.ID, &billing.ReservationID, &billing.Amount, &billing.PaymentStatus)
+	// Get the billing details
+	billing, err := scanBilling(billingDB.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ?", billingID))
 	if err == sql.ErrNoRows {
 		http.Error(w, "Billing not found", http.StatusNotFound)
 		return
@@ -87,123 +113,520 @@ func generateInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get reservation details from vehicle reservation database
-	var reservationDetails struct {
-		VehicleID int
-		UserID    int
+	if billing.PaymentStatus == billingPending || billing.PaymentStatus == billingVoid {
+		http.Error(w, "Payment not completed for this billing", http.StatusBadRequest)
+		return
 	}
-	err = vehicleDB.QueryRow("SELECT vehicle_id, user_id FROM reservations WHERE id = ?", billing.ReservationID).
-		Scan(&reservationDetails.VehicleID, &reservationDetails.UserID)
+
+	// The receipt is for the payment that settled the billing
+	var paidAt, reference, method, cardLast4 string
+	err = billingDB.QueryRow("SELECT completed_at, gateway_reference, method, card_last4 FROM payments WHERE billing_id = ? AND status = ? ORDER BY id DESC LIMIT 1",
+		billing.ID, paymentSucceeded).Scan(&paidAt, &reference, &method, &cardLast4)
 	if err != nil {
-		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch payment details", http.StatusInternalServerError)
 		return
 	}
-
-	// Get user details from user management database
-	var userName string
-	err = userDB.QueryRow("SELECT name FROM users WHERE id = ?", reservationDetails.UserID).Scan(&userName)
+	paymentDate, err := time.ParseInLocation(mysqlDateTimeLayout, paidAt, time.Local)
 	if err != nil {
-		http.Error(w, "Failed to fetch user details", http.StatusInternalServerError)
+		http.Error(w, "Failed to parse payment date", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate the invoice
-	invoice := Invoice{
-		InvoiceID:     billing.ID,
-		BillingID:     billing.ID,
-		ReservationID: billing.ReservationID,
-		Amount:        billing.Amount,
-		GeneratedDate: time.Now(),
+	// Generate receipt
+	receipt := Receipt{
+		ReceiptID:        billing.ID,
+		BillingID:        billing.ID,
+		Amount:           billing.Amount,
+		TaxAmount:        billing.TaxAmount,
+		PaymentDate:      paymentDate,
+		PaymentReference: reference,
+		PaymentMethod:    method,
+		CardLast4:        cardLast4,
+	}
+
+	if wantsPDF(r) {
+		invoice, err := invoiceForBilling(billing.ID)
+		if err != nil {
+			log.Printf("Failed to generate invoice for billing %d: %v", billing.ID, err)
+			http.Error(w, "Failed to generate invoice", http.StatusInternalServerError)
+			return
+		}
+		writePDF(w, fmt.Sprintf("receipt-%d.pdf", receipt.ReceiptID), renderReceiptPDF(receipt, invoice))
+		return
 	}
 
-	// Return the invoice as a response
+	// Return receipt
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(receipt)
 }
 
-func generateReceipt(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	billingID := params["billing_id"]
+// getVehiclePricing returns the hourly base rate of a vehicle type in a currency
+func getVehiclePricing(vehicleType, currency string) (Money, error) {
+	var baseRate moneyColumn
+	err := billingDB.QueryRow("SELECT base_rate_per_hour FROM vehicle_pricing WHERE vehicle_type = ? AND currency = ?", vehicleType, currency).
+		Scan(&baseRate)
+	if err != nil {
+		return Money{}, err
+	}
+	return baseRate.money(currency)
+}
 
-	// Get the billing details
-	var billing Billing
-	err := billingDB.QueryRow("SELECT id, amount, payment_status FROM billings WHERE id = ?", billingID).
-		Scan(&billing.ID, &billing.Amount, &billing.PaymentStatus)
+// membershipDiscount returns the discount percentage of a membership tier from
+// its membership_benefits row. Tiers without a row get no discount.
+func membershipDiscount(tier string) (float64, error) {
+	var rate float64
+	err := userDB.QueryRow("SELECT discount_rate FROM membership_benefits WHERE tier = ?", tier).Scan(&rate)
 	if err == sql.ErrNoRows {
-		http.Error(w, "Billing not found", http.StatusNotFound)
+		return 0, nil
+	}
+	return rate, err
+}
+
+// pricingCurrency is the currency a vehicle type is billed in for a customer:
+// their preferred currency if the vehicle type has a rate in it, otherwise
+// the default currency
+func pricingCurrency(vehicleType, preferredCurrency string) (string, error) {
+	var count int
+	err := billingDB.QueryRow("SELECT COUNT(*) FROM vehicle_pricing WHERE vehicle_type = ? AND currency = ?", vehicleType, preferredCurrency).Scan(&count)
+	if err != nil || count == 0 {
+		return defaultCurrency, err
+	}
+	return preferredCurrency, nil
+}
+
+func calculateCost(vehicleType string, membershipLevel string, currency string, startTime, endTime time.Time) (Money, error) {
+	baseRate, err := getVehiclePricing(vehicleType, currency)
+	if err != nil {
+		return Money{}, fmt.Errorf("failed to fetch vehicle pricing: %v", err)
+	}
+
+	// Charge the base rate for the rental duration, to the second
+	baseCost := baseRate.Prorate(endTime.Sub(startTime))
+
+	// Determine the discount based on membership level
+	discount, err := membershipDiscount(membershipLevel)
+	if err != nil {
+		return Money{}, fmt.Errorf("failed to fetch membership discount: %v", err)
+	}
+
+	// Calculate the total cost
+	totalCost := baseCost.Sub(baseCost.Percent(discount))
+	return totalCost, nil
+}
+
+func scanBilling(row interface{ Scan(...interface{}) error }) (Billing, error) {
+	var b Billing
+	var currency string
+	var amount, taxAmount, cancellationFee, overtimeFee moneyColumn
+	err := row.Scan(&b.ID, &b.ReservationID, &b.UserID, &currency, &amount, &taxAmount, &b.TaxInclusive, &b.PaymentStatus, &cancellationFee, &overtimeFee, &b.OvertimeMinutes)
+	if err != nil {
+		return b, err
+	}
+	if b.Amount, err = amount.money(currency); err != nil {
+		return b, err
+	}
+	if b.TaxAmount, err = taxAmount.money(currency); err != nil {
+		return b, err
+	}
+	if cancellationFee.Valid {
+		fee, err := cancellationFee.money(currency)
+		if err != nil {
+			return b, err
+		}
+		b.CancellationFee = &fee
+	}
+	if overtimeFee.Valid {
+		fee, err := overtimeFee.money(currency)
+		if err != nil {
+			return b, err
+		}
+		b.OvertimeFee = &fee
+	}
+	return b, nil
+}
+
+// reservationDetails is what billing needs to know about a reservation
+type reservationDetails struct {
+	ID             int
+	VehicleID      int
+	UserID         int
+	Status         string
+	StartTime      time.Time
+	EndTime        time.Time
+	CancelledAt    time.Time // zero unless the reservation was cancelled
+	ReturnedAt     time.Time // zero until the vehicle has been returned
+	VehicleType    string
+	Location       string // tax jurisdiction of the vehicle
+	MembershipTier string
+	Currency       string // currency the reservation is priced in
+	QuoteID        string // signed quote the booking was made with, if any
+}
+
+// loadReservation collects a reservation with its vehicle type and the
+// membership tier of its user from the vehicle and user databases
+func loadReservation(reservationID int) (reservationDetails, error) {
+	d := reservationDetails{ID: reservationID}
+	var start, end, cancelledAt, returnedAt string
+	err := vehicleDB.QueryRow(`
+		SELECT r.vehicle_id, r.user_id, r.status, r.start_time, r.end_time, COALESCE(r.cancelled_at, ''), COALESCE(r.returned_at, ''), COALESCE(r.quote_id, ''), v.vehicle_type, v.location
+		FROM reservations r
+		JOIN vehicles v ON v.id = r.vehicle_id
+		WHERE r.id = ?`, reservationID).
+		Scan(&d.VehicleID, &d.UserID, &d.Status, &start, &end, &cancelledAt, &returnedAt, &d.QuoteID, &d.VehicleType, &d.Location)
+	if err != nil {
+		return d, err
+	}
+
+	if d.StartTime, err = time.ParseInLocation(mysqlDateTimeLayout, start, time.Local); err != nil {
+		return d, fmt.Errorf("invalid reservation start time: %v", err)
+	}
+	if d.EndTime, err = time.ParseInLocation(mysqlDateTimeLayout, end, time.Local); err != nil {
+		return d, fmt.Errorf("invalid reservation end time: %v", err)
+	}
+	if cancelledAt != "" {
+		if d.CancelledAt, err = time.ParseInLocation(mysqlDateTimeLayout, cancelledAt, time.Local); err != nil {
+			return d, fmt.Errorf("invalid reservation cancellation time: %v", err)
+		}
+	}
+	if returnedAt != "" {
+		if d.ReturnedAt, err = time.ParseInLocation(mysqlDateTimeLayout, returnedAt, time.Local); err != nil {
+			return d, fmt.Errorf("invalid reservation return time: %v", err)
+		}
+	}
+
+	if err := loadCustomer(&d); err != nil {
+		return d, fmt.Errorf("failed to fetch customer: %v", err)
+	}
+	return d, nil
+}
+
+// loadCustomer sets the membership tier of the reservation's user and the
+// currency it is priced in. VehicleType and UserID must already be set.
+func loadCustomer(d *reservationDetails) error {
+	var preferredCurrency string
+	err := userDB.QueryRow("SELECT membership_tier, preferred_currency FROM users WHERE id = ?", d.UserID).Scan(&d.MembershipTier, &preferredCurrency)
+	if err != nil {
+		return err
+	}
+	d.Currency, err = pricingCurrency(d.VehicleType, preferredCurrency)
+	return err
+}
+
+// reservationCost prices a reservation with calculateCost
+func reservationCost(d reservationDetails) (Money, error) {
+	return calculateCost(d.VehicleType, d.MembershipTier, d.Currency, d.StartTime, d.EndTime)
+}
+
+// reservationBaseCost prices a reservation at the vehicle's base rate, before any discount
+func reservationBaseCost(d reservationDetails) (Money, error) {
+	baseRate, err := getVehiclePricing(d.VehicleType, d.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return baseRate.Prorate(d.EndTime.Sub(d.StartTime)), nil
+}
+
+// createBillingForReservation prices a reservation with calculateCost, or at the
+// price of the quote it was booked with, and stores a Pending billing for it,
+// redeeming promoCode if one is given and adding the tax of the vehicle's
+// location, and the overtime of a late return. Each reservation is billed at
+// most once.
+func createBillingForReservation(reservationID int, promoCode string) (Billing, error) {
+	d, err := loadReservation(reservationID)
+	if err != nil {
+		return Billing{}, err
+	}
+	if d.Status == "cancelled" {
+		return Billing{}, errReservationCancelled
+	}
+	if d.Status == "pending" {
+		return Billing{}, errReservationPending
+	}
+
+	var quote *QuoteClaims
+	if d.QuoteID != "" {
+		if quote, err = parseQuoteToken(d.QuoteID, false); err != nil || !quote.matches(d.VehicleID, d.UserID, d.StartTime, d.EndTime) {
+			log.Printf("Ignoring quote of reservation %d: it does not match the booking", reservationID)
+			quote = nil
+		} else {
+			// Bill in the quoted currency even if the customer's preference changed since
+			d.Currency = quote.Currency
+		}
+	}
+	cost, err := reservationCost(d)
+	if err != nil {
+		return Billing{}, err
+	}
+	if quote != nil {
+		cost = quote.amount()
+	}
+
+	billing := Billing{
+		ReservationID: reservationID,
+		UserID:        d.UserID,
+		Amount:        cost,
+		PaymentStatus: billingPending,
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return Billing{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO billings (reservation_id, user_id, currency, amount, payment_status) VALUES (?, ?, ?, ?, ?)",
+		billing.ReservationID, billing.UserID, billing.Amount.Currency, billing.Amount, billing.PaymentStatus)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return Billing{}, errBillingExists
+		}
+		return Billing{}, err
+	}
+	id, _ := res.LastInsertId()
+	billing.ID = int(id)
+
+	// Discounts apply to the price before tax
+	promoDiscount := zeroMoney(cost.Currency)
+	if quote != nil && quote.PromoCode != "" {
+		discount, err := redeemQuotedPromotion(tx, quote, billing)
+		if err != nil {
+			return Billing{}, err
+		}
+		promoDiscount = promoDiscount.Add(discount)
+		billing.Amount = billing.Amount.Sub(discount)
+	}
+	if promoCode != "" {
+		base, err := reservationBaseCost(d)
+		if err != nil {
+			return Billing{}, err
+		}
+		discount, err := redeemPromotion(tx, promoCode, billing, base)
+		if err != nil {
+			return Billing{}, err
+		}
+		promoDiscount = promoDiscount.Add(discount)
+		billing.Amount = billing.Amount.Sub(discount)
+	}
+
+	// A quoted booking is taxed at the rate it was quoted with
+	var taxRate TaxRate
+	if quote != nil {
+		taxRate, err = quote.taxRate(d.Location)
+	} else {
+		taxRate, err = taxRateFor(d.Location)
+	}
+	if err != nil {
+		return Billing{}, err
+	}
+	setBillingPrice(&billing, billing.Amount, taxRate)
+	if _, err := tx.Exec("UPDATE billings SET amount = ?, tax_amount = ?, tax_inclusive = ? WHERE id = ?",
+		billing.Amount, billing.TaxAmount, billing.TaxInclusive, billing.ID); err != nil {
+		return Billing{}, err
+	}
+	if err := postCharge(tx, billing, promoDiscount); err != nil {
+		return Billing{}, err
+	}
+	// Reservations billed after the vehicle came back include any late return
+	if billing, err = addOvertime(tx, billing); err != nil {
+		return Billing{}, err
+	}
+	return billing, tx.Commit()
+}
+
+// Bill a reservation. Called by Vehicle_Management when a reservation is created
+// or completed; calling it again for the same reservation returns the existing billing.
+func createBillingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		ReservationID int    `json:"reservation_id"`
+		PromoCode     string `json:"promo_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int
+	err := vehicleDB.QueryRow("SELECT user_id FROM reservations WHERE id = ?", input.ReservationID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		http.Error(w, "Failed to fetch billing data", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeReservationAccess(w, r, ownerID) {
 		return
 	}
 
-	if billing.PaymentStatus != "Paid" {
-		http.Error(w, "Payment not completed for this billing", http.StatusBadRequest)
+	billing, err := createBillingForReservation(input.ReservationID, input.PromoCode)
+	if errors.Is(err, errBillingExists) {
+		billing, err = scanBilling(billingDB.QueryRow("SELECT "+billingColumns+" FROM billings WHERE reservation_id = ?", input.ReservationID))
+		if err != nil {
+			http.Error(w, "Failed to fetch billing data", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(billing)
+		return
+	} else if errors.Is(err, errReservationCancelled) {
+		http.Error(w, "Reservation has been cancelled", http.StatusConflict)
+		return
+	} else if errors.Is(err, errReservationPending) {
+		http.Error(w, "Reservation is waiting for its deposit to be confirmed", http.StatusConflict)
+		return
+	} else if isPromotionError(err) {
+		writePromotionError(w, err)
+		return
+	} else if err != nil {
+		log.Printf("Failed to bill reservation %d: %v", input.ReservationID, err)
+		http.Error(w, "Failed to create billing", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate receipt
-	receipt := Receipt{
-		ReceiptID:   billing.ID,
-		BillingID:   billing.ID,
-		Amount:      billing.Amount,
-		PaymentDate: time.Now(),
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(billing)
+}
+
+func getBillingHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	billing, err := scanBilling(billingDB.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ?", billingID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Billing not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch billing data", http.StatusInternalServerError)
+		return
 	}
 
-	// Return receipt
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(receipt)
+	json.NewEncoder(w).Encode(billing)
 }
 
-func getVehiclePricing(vehicleType string) (float64, float64, float64, float64, error) {
-	var baseRate, discountBasic, discountPremium, discountVIP float64
-	err := billingDB.QueryRow("SELECT base_rate_per_hour, discount_basic, discount_premium, discount_vip FROM vehicle_pricing WHERE vehicle_type = ?", vehicleType).
-		Scan(&baseRate, &discountBasic, &discountPremium, &discountVIP)
-	if err != nil {
-		return 0, 0, 0, 0, err
+// List billings of one user. Billing staff may omit user_id to list every billing.
+func getBillingsHandler(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + billingColumns + " FROM billings"
+	var args []interface{}
+
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		id, err := strconv.Atoi(userID)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if !authorizeUserAccess(w, r, id) {
+			return
+		}
+		query += " WHERE user_id = ?"
+		args = append(args, id)
+	} else if claims, _ := claimsFromContext(r.Context()); !claims.hasRole(billingStaffRoles...) {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
 	}
-	return baseRate, discountBasic, discountPremium, discountVIP, nil
-}
 
-func calculateCost(vehicleType string, membershipLevel string, startTime, endTime time.Time) (float64, error) {
-	baseRate, discountBasic, discountPremium, discountVIP, err := getVehiclePricing(vehicleType)
+	rows, err := billingDB.Query(query+" ORDER BY id DESC", args...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to fetch vehicle pricing: %v", err)
+		http.Error(w, "Failed to fetch billings", http.StatusInternalServerError)
+		return
 	}
+	defer rows.Close()
 
-	// Calculate rental duration in hours
-	rentalDuration := endTime.Sub(startTime).Hours()
-
-	// Determine the discount based on membership level
-	discount := 0.0
-	switch membershipLevel {
-	case "Basic":
-		discount = discountBasic
-	case "Premium":
-		discount = discountPremium
-	case "VIP":
-		discount = discountVIP
+	billings := []Billing{}
+	for rows.Next() {
+		billing, err := scanBilling(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse billing data", http.StatusInternalServerError)
+			return
+		}
+		billings = append(billings, billing)
 	}
 
-	// Calculate the total cost
-	totalCost := rentalDuration * baseRate * (1 - discount/100)
-	return totalCost, nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(billings)
 }
 
 func main() {
+	requireJWTSecret()
 	initDB()
 	defer billingDB.Close()
 	defer vehicleDB.Close()
 	defer userDB.Close()
 
+	if exchangeRatesFile != "" {
+		if err := loadExchangeRatesFile(exchangeRatesFile); err != nil {
+			log.Fatalf("Failed to load exchange rates: %v", err)
+		}
+	}
+
+	schedule, err := parseRetryDays(dunningRetryDays)
+	if err != nil {
+		log.Fatalf("Invalid DUNNING_RETRY_DAYS: %v", err)
+	}
+	dunningSchedule = schedule
+
+	go releaseExpiredDepositsEvery(depositSweepInterval)
+	go retryDuePaymentsEvery(dunningInterval)
+	go generateStatementsEvery(statementInterval)
+
 	router := mux.NewRouter()
+	router.Use(authMiddleware)
+	router.HandleFunc("/billings", createBillingHandler).Methods("POST")
+	router.HandleFunc("/billings", getBillingsHandler).Methods("GET")
+	router.HandleFunc("/billings/{id}", getBillingHandler).Methods("GET")
+	router.HandleFunc("/billings/{id}/payments", createPaymentHandler).Methods("POST")
+	router.HandleFunc("/billings/{id}/payments", getPaymentsHandler).Methods("GET")
+	router.HandleFunc("/billings/{id}/payments/{payment_id}/confirm", confirmPaymentHandler).Methods("POST")
+	router.HandleFunc("/billings/{id}/refunds", requireRole(createRefundHandler, billingStaffRoles...)).Methods("POST")
+	router.HandleFunc("/billings/{id}/refunds", getRefundsHandler).Methods("GET")
+	router.HandleFunc("/billings/{id}/apply-promo", applyPromoHandler).Methods("POST")
+	router.HandleFunc("/billings/{id}/ledger", getBillingLedgerHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/balance", getUserBalanceHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/dunning", getDunningHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/statements", getStatementsHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/statements/{statement_id:[0-9]+}.csv", getStatementHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/statements/{statement_id:[0-9]+}.pdf", getStatementHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/statements/{statement_id}", getStatementHandler).Methods("GET")
+	router.HandleFunc("/statements/generate", requireRole(generateStatementsHandler, roleBillingAdmin)).Methods("POST")
+	router.HandleFunc("/users/{id}/wallet", getWalletHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/wallet/top-ups", createTopUpHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/wallet/top-ups/{top_up_id}/confirm", confirmTopUpHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/wallet/credits", requireRole(createWalletCreditHandler, billingStaffRoles...)).Methods("POST")
+	router.HandleFunc("/ledger/reconciliation", requireRole(getReconciliationHandler, billingStaffRoles...)).Methods("GET")
+	router.HandleFunc("/promotions", requireRole(getPromotionsHandler, billingStaffRoles...)).Methods("GET")
+	router.HandleFunc("/promotions", requireRole(createPromotionHandler, roleBillingAdmin)).Methods("POST")
+	router.HandleFunc("/promotions/{id}", requireRole(getPromotionHandler, billingStaffRoles...)).Methods("GET")
+	router.HandleFunc("/promotions/{id}", requireRole(updatePromotionHandler, roleBillingAdmin)).Methods("PUT")
+	router.HandleFunc("/promotions/{id}", requireRole(deletePromotionHandler, roleBillingAdmin)).Methods("DELETE")
+	router.HandleFunc("/cancellations", settleCancellationHandler).Methods("POST")
+	router.HandleFunc("/reschedules", settleRescheduleHandler).Methods("POST")
+	router.HandleFunc("/deposits", createDepositHoldHandler).Methods("POST")
+	router.HandleFunc("/deposits/{id}/confirm", confirmDepositHoldHandler).Methods("POST")
+	router.HandleFunc("/deposits/{id}/capture", requireRole(captureDepositHandler, billingStaffRoles...)).Methods("POST")
+	router.HandleFunc("/deposits/{id}/void", requireRole(voidDepositHandler, billingStaffRoles...)).Methods("POST")
+	router.HandleFunc("/reservations/{id}/deposit", getReservationDepositHandler).Methods("GET")
+	router.HandleFunc("/cancellation-policy", getCancellationPolicyHandler).Methods("GET")
+	router.HandleFunc("/late-returns", lateReturnHandler).Methods("POST")
+	router.HandleFunc("/late-return-policy", getLateReturnPolicyHandler).Methods("GET")
+	router.HandleFunc("/quotes", getQuoteHandler).Methods("GET")
+	router.HandleFunc("/tax-rates", getTaxRatesHandler).Methods("GET")
+	router.HandleFunc("/tax-rates/{jurisdiction}", requireRole(putTaxRateHandler, roleBillingAdmin)).Methods("PUT")
+	router.HandleFunc("/tax-rates/{jurisdiction}", requireRole(deleteTaxRateHandler, roleBillingAdmin)).Methods("DELETE")
+	router.HandleFunc("/exchange-rates", requireRole(getExchangeRatesHandler, billingStaffRoles...)).Methods("GET")
+	router.HandleFunc("/exchange-rates", requireRole(importExchangeRatesHandler, roleBillingAdmin)).Methods("POST")
+	router.HandleFunc("/reports/revenue", requireRole(getRevenueReportHandler, billingStaffRoles...)).Methods("GET")
+	router.HandleFunc("/invoices/{billing_id:[0-9]+}.pdf", generateInvoice).Methods("GET")
+	router.HandleFunc("/receipts/{billing_id:[0-9]+}.pdf", generateReceipt).Methods("GET")
 	router.HandleFunc("/invoices/{billing_id}", generateInvoice).Methods("GET")
 	router.HandleFunc("/receipts/{billing_id}", generateReceipt).Methods("GET")
 
 	// Configure CORS
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}), // Replace "*" with the frontend origin if needed
-		handlers.AllowedMethods([]string{"GET", "OPTIONS"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
 		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
 	)
 
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// CancellationRule charges FeePercentage of the booking when it is cancelled
+// with less than HoursBeforeStart hours of notice. A rule with 0 hours applies
+// once the reservation has started.
+type CancellationRule struct {
+	HoursBeforeStart float64 `json:"hours_before_start"`
+	FeePercentage    float64 `json:"fee_percentage"`
+}
+
+// CancellationSettlement is what Billing_Management did about a cancelled reservation
+type CancellationSettlement struct {
+	ReservationID   int     `json:"reservation_id"`
+	BillingID       int     `json:"billing_id,omitempty"`
+	FeePercentage   float64 `json:"fee_percentage"`
+	CancellationFee Money   `json:"cancellation_fee"`
+	Refund          *Refund `json:"refund"`
+}
+
+// cancellationRules loads the policy of a membership tier from cancellation_policies,
+// falling back to the default policy (membership_tier NULL) for tiers without one
+func cancellationRules(membershipTier string) ([]CancellationRule, error) {
+	rules, err := queryCancellationRules("SELECT hours_before_start, fee_percentage FROM cancellation_policies WHERE membership_tier = ?", membershipTier)
+	if err != nil || len(rules) > 0 {
+		return rules, err
+	}
+	return queryCancellationRules("SELECT hours_before_start, fee_percentage FROM cancellation_policies WHERE membership_tier IS NULL")
+}
+
+func queryCancellationRules(query string, args ...interface{}) ([]CancellationRule, error) {
+	rows, err := billingDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []CancellationRule
+	for rows.Next() {
+		var rule CancellationRule
+		if err := rows.Scan(&rule.HoursBeforeStart, &rule.FeePercentage); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// cancellationFeePercentage is the highest fee among the rules whose notice
+// period was not met. Cancelling earlier than every rule is free.
+func cancellationFeePercentage(rules []CancellationRule, notice time.Duration) float64 {
+	fee := 0.0
+	for _, rule := range rules {
+		if notice.Hours() < rule.HoursBeforeStart && rule.FeePercentage > fee {
+			fee = rule.FeePercentage
+		}
+	}
+	return fee
+}
+
+// settleCancellation applies the cancellation fee to the reservation's billing:
+// an unpaid billing is reduced to the fee (or voided when there is none), a paid
+// one is refunded everything above the fee, and an unbilled reservation is billed
+// for the fee alone. It runs in one transaction under the billing row lock, so
+// the payment status it acts on cannot change underneath it, and the refund,
+// the fee and their ledger entries are recorded together or not at all.
+func settleCancellation(d reservationDetails) (CancellationSettlement, error) {
+	settlement := CancellationSettlement{ReservationID: d.ID}
+
+	rules, err := cancellationRules(d.MembershipTier)
+	if err != nil {
+		return settlement, err
+	}
+	settlement.FeePercentage = cancellationFeePercentage(rules, d.StartTime.Sub(d.CancelledAt))
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return settlement, err
+	}
+	defer tx.Rollback()
+
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE reservation_id = ? FOR UPDATE", d.ID))
+
+	if err == sql.ErrNoRows {
+		cost, err := reservationCost(d)
+		if err != nil {
+			return settlement, err
+		}
+		taxRate, err := taxRateFor(d.Location)
+		if err != nil {
+			return settlement, err
+		}
+		billing = Billing{ReservationID: d.ID, UserID: d.UserID, PaymentStatus: billingPending}
+		setBillingPrice(&billing, cost.Percent(settlement.FeePercentage), taxRate)
+		settlement.CancellationFee = billing.Amount
+		if settlement.CancellationFee.IsZero() {
+			return settlement, nil
+		}
+		res, err := tx.Exec("INSERT INTO billings (reservation_id, user_id, currency, amount, tax_amount, tax_inclusive, payment_status, cancellation_fee) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			d.ID, d.UserID, billing.Amount.Currency, billing.Amount, billing.TaxAmount, billing.TaxInclusive, billingPending, settlement.CancellationFee)
+		if err != nil {
+			return settlement, err
+		}
+		id, _ := res.LastInsertId()
+		billing.ID = int(id)
+		settlement.BillingID = billing.ID
+		if err := postFee(tx, billing, cancellationFeeDescription(settlement.FeePercentage)); err != nil {
+			return settlement, err
+		}
+		return settlement, tx.Commit()
+	} else if err != nil {
+		return settlement, err
+	}
+
+	settlement.BillingID = billing.ID
+	if billing.CancellationFee != nil {
+		// Already settled; report the original outcome
+		settlement.CancellationFee = *billing.CancellationFee
+		refund, err := scanRefund(tx.QueryRow("SELECT "+refundColumns+" FROM refunds WHERE billing_id = ? AND reason_code = ?", billing.ID, refundReservationCancelled))
+		if err == nil {
+			settlement.Refund = &refund
+		} else if err != sql.ErrNoRows {
+			return settlement, err
+		}
+		return settlement, nil
+	}
+
+	settlement.CancellationFee = billing.Amount.Percent(settlement.FeePercentage)
+
+	var refundID int64
+	switch billing.PaymentStatus {
+	case billingPending:
+		status := billingPending
+		if settlement.CancellationFee.IsZero() {
+			status = billingVoid
+		}
+		// The fee carries the same share of tax as the booking
+		settled := billing
+		settled.Amount, settled.TaxAmount = settlement.CancellationFee, billing.TaxAmount.Percent(settlement.FeePercentage)
+
+		_, err = tx.Exec("UPDATE billings SET amount = ?, tax_amount = ?, payment_status = ?, cancellation_fee = ? WHERE id = ?",
+			settled.Amount, settled.TaxAmount, status, settlement.CancellationFee, billing.ID)
+		if err != nil {
+			return settlement, err
+		}
+		// The booking is reversed in full and the fee charged on its own
+		cancelled := billing
+		cancelled.Amount, cancelled.TaxAmount = zeroMoney(billing.Amount.Currency), zeroMoney(billing.Amount.Currency)
+		if err := postReprice(tx, ledgerAdjustment, "Reservation cancelled", accountRevenue, billing, cancelled); err != nil {
+			return settlement, err
+		}
+		if err := postFee(tx, settled, cancellationFeeDescription(settlement.FeePercentage)); err != nil {
+			return settlement, err
+		}
+		return settlement, tx.Commit()
+
+	case billingPaid, billingPartiallyRefunded:
+		// Anything already refunded by staff counts towards the cancellation refund
+		balance, err := refundableBalance(tx, billing.ID)
+		if err != nil {
+			return settlement, err
+		}
+		if refundAmount := billing.Amount.Sub(settlement.CancellationFee).Min(balance); refundAmount.IsPositive() {
+			if refundID, err = refundInTx(tx, billing.ID, refundAmount, refundReservationCancelled, "Automatic refund on cancellation"); err != nil {
+				return settlement, err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE billings SET cancellation_fee = ? WHERE id = ?", settlement.CancellationFee, billing.ID); err != nil {
+		return settlement, err
+	}
+	if err := tx.Commit(); err != nil {
+		return settlement, err
+	}
+	if refundID != 0 {
+		refund, err := scanRefund(billingDB.QueryRow("SELECT "+refundColumns+" FROM refunds WHERE id = ?", refundID))
+		if err != nil {
+			return settlement, err
+		}
+		settlement.Refund = &refund
+	}
+	return settlement, nil
+}
+
+func cancellationFeeDescription(feePercentage float64) string {
+	return fmt.Sprintf("Cancellation fee (%s%% of the booking)", strconv.FormatFloat(feePercentage, 'f', -1, 64))
+}
+
+// Apply the cancellation policy to a reservation Vehicle_Management has just
+// cancelled. Calling it again for the same reservation returns the same outcome.
+func settleCancellationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		ReservationID int `json:"reservation_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	d, err := loadReservation(input.ReservationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeReservationAccess(w, r, d.UserID) {
+		return
+	}
+	if d.Status != "cancelled" || d.CancelledAt.IsZero() {
+		http.Error(w, "Reservation has not been cancelled", http.StatusConflict)
+		return
+	}
+
+	settlement, err := settleCancellation(d)
+	if err != nil {
+		log.Printf("Failed to settle cancellation of reservation %d: %v", d.ID, err)
+		writeRefundError(w, err)
+		return
+	}
+	// A cancelled reservation needs no deposit
+	if err := releaseReservationDeposit(d.ID); err != nil {
+		log.Printf("Failed to release deposit of reservation %d: %v", d.ID, err)
+	}
+	json.NewEncoder(w).Encode(settlement)
+}
+
+// Show the cancellation policy that applies to a membership tier
+func getCancellationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := cancellationRules(r.URL.Query().Get("tier"))
+	if err != nil {
+		http.Error(w, "Failed to fetch cancellation policy", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []CancellationRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of a deposit hold, stored in deposit_holds.status
+const (
+	holdRequiresAction = "requires_action" // waiting on a 3-D Secure challenge
+	holdAuthorized     = "authorized"      // the deposit is held on the card
+	holdDeclined       = "declined"
+	holdCaptured       = "captured" // part or all of the deposit was kept; the rest was released
+	holdReleased       = "released"
+)
+
+// Hours after a reservation ends that an uncaptured deposit is released
+var depositReleaseHours = getEnvInt("DEPOSIT_RELEASE_HOURS", 72)
+
+// Minutes a customer has to pass the 3-D Secure challenge of a deposit hold.
+// Holds still waiting after that are released, and Vehicle_Management drops
+// the pending reservation.
+var depositChallengeMinutes = getEnvInt("DEPOSIT_CHALLENGE_MINUTES", 15)
+
+// How often expired deposit holds are looked for
+const depositSweepInterval = time.Minute
+
+var (
+	errNoDepositRequired  = errors.New("no deposit is required for this reservation")
+	errDepositHeld        = errors.New("reservation already has a deposit hold")
+	errHoldNotAuthorized  = errors.New("deposit is not held")
+	errCaptureExceedsHold = errors.New("capture exceeds the deposit held")
+	errChallengeExpired   = errors.New("deposit confirmation has expired")
+)
+
+// DepositHold is a security deposit authorized on the customer's card for a
+// reservation. It is captured in part or in full for damages and fees after
+// the vehicle is returned, or released.
+type DepositHold struct {
+	ID             int    `json:"id"`
+	ReservationID  int    `json:"reservation_id"`
+	UserID         int    `json:"user_id"`
+	Amount         Money  `json:"amount"`
+	CapturedAmount Money  `json:"captured_amount"`
+	Status         string `json:"status"`
+	Reference      string `json:"gateway_reference"`
+	FailureReason  string `json:"failure_reason,omitempty"`
+	CardLast4      string `json:"card_last4"`
+	CaptureNote    string `json:"capture_note,omitempty"`
+	RedirectURL    string `json:"redirect_url,omitempty"`
+	ReleaseAfter   string `json:"release_after"` // when an uncaptured hold is released automatically
+	CreatedAt      string `json:"created_at"`
+	ClosedAt       string `json:"closed_at,omitempty"` // when it was captured or released
+}
+
+const depositHoldColumns = "id, reservation_id, user_id, currency, amount, captured_amount, status, gateway_reference, COALESCE(failure_reason, ''), card_last4, COALESCE(capture_note, ''), release_after, created_at, COALESCE(closed_at, '')"
+
+func scanDepositHold(row interface{ Scan(...interface{}) error }) (DepositHold, error) {
+	var h DepositHold
+	var currency string
+	var amount, captured moneyColumn
+	err := row.Scan(&h.ID, &h.ReservationID, &h.UserID, &currency, &amount, &captured, &h.Status, &h.Reference, &h.FailureReason, &h.CardLast4, &h.CaptureNote, &h.ReleaseAfter, &h.CreatedAt, &h.ClosedAt)
+	if err != nil {
+		return h, err
+	}
+	if h.Amount, err = amount.money(currency); err != nil {
+		return h, err
+	}
+	h.CapturedAmount, err = captured.money(currency)
+	return h, err
+}
+
+// holdStatus maps a gateway outcome to the state of the hold it placed
+func holdStatus(paymentStatus string) string {
+	switch paymentStatus {
+	case paymentSucceeded:
+		return holdAuthorized
+	case paymentRequiresAction:
+		return holdRequiresAction
+	}
+	return holdDeclined
+}
+
+// depositAmount is the deposit required for a reservation's vehicle type in
+// the currency the reservation is priced in, or zero when none is required
+func depositAmount(d reservationDetails) (Money, error) {
+	var deposit moneyColumn
+	err := billingDB.QueryRow("SELECT deposit FROM vehicle_pricing WHERE vehicle_type = ? AND currency = ?", d.VehicleType, d.Currency).Scan(&deposit)
+	if err == sql.ErrNoRows {
+		return zeroMoney(d.Currency), nil
+	} else if err != nil {
+		return Money{}, err
+	}
+	return deposit.money(d.Currency)
+}
+
+// releaseHold voids a hold that has not been captured. Holds already closed
+// are left as they are.
+func releaseHold(holdID int) error {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hold, err := scanDepositHold(tx.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ? FOR UPDATE", holdID))
+	if err != nil {
+		return err
+	}
+	if hold.Status != holdAuthorized && hold.Status != holdRequiresAction {
+		return nil
+	}
+	if err := paymentGateway.Void(hold.Reference); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE deposit_holds SET status = ?, closed_at = NOW() WHERE id = ?", holdReleased, hold.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// releaseReservationDeposit releases any open hold of a reservation, e.g. when
+// it is cancelled
+func releaseReservationDeposit(reservationID int) error {
+	var holdID int
+	err := billingDB.QueryRow("SELECT id FROM deposit_holds WHERE reservation_id = ? AND status IN (?, ?)",
+		reservationID, holdAuthorized, holdRequiresAction).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return releaseHold(holdID)
+}
+
+// releaseExpiredDeposits releases every open hold past its release time, and
+// every hold whose 3-D Secure challenge was not passed in time
+func releaseExpiredDeposits() {
+	rows, err := billingDB.Query(`
+		SELECT id FROM deposit_holds
+		WHERE (status IN (?, ?) AND release_after <= NOW())
+		OR (status = ? AND created_at <= NOW() - INTERVAL ? MINUTE)`,
+		holdAuthorized, holdRequiresAction, holdRequiresAction, depositChallengeMinutes)
+	if err != nil {
+		log.Printf("Failed to look for expired deposit holds: %v", err)
+		return
+	}
+	var holdIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Failed to read expired deposit hold: %v", err)
+			break
+		}
+		holdIDs = append(holdIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range holdIDs {
+		if err := releaseHold(id); err != nil {
+			log.Printf("Failed to release deposit hold %d: %v", id, err)
+			continue
+		}
+		log.Printf("Released expired deposit hold %d", id)
+	}
+}
+
+// releaseExpiredDepositsEvery runs releaseExpiredDeposits now and then at
+// every interval. It never returns.
+func releaseExpiredDepositsEvery(interval time.Duration) {
+	for {
+		releaseExpiredDeposits()
+		time.Sleep(interval)
+	}
+}
+
+// writeDepositError maps deposit errors to HTTP responses
+func writeDepositError(w http.ResponseWriter, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Deposit hold not found", http.StatusNotFound)
+	case errors.Is(err, errNoDepositRequired):
+		http.Error(w, "No deposit is required for this reservation", http.StatusConflict)
+	case errors.Is(err, errDepositHeld):
+		http.Error(w, "Reservation already has a deposit hold", http.StatusConflict)
+	case errors.Is(err, errHoldNotAuthorized):
+		http.Error(w, "Deposit is not held", http.StatusConflict)
+	case errors.Is(err, errChallengeExpired):
+		http.Error(w, "Deposit confirmation has expired", http.StatusConflict)
+	case errors.Is(err, errCurrencyMismatch):
+		http.Error(w, "Capture must be in the currency of the deposit", http.StatusBadRequest)
+	case errors.Is(err, errCaptureExceedsHold):
+		http.Error(w, "Capture amount must be positive and no more than the deposit held", http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Deposit hold failed: %v", err)
+		http.Error(w, "Failed to update deposit hold", http.StatusInternalServerError)
+	}
+}
+
+// Place the security deposit hold of a reservation on a card. Vehicle_Management
+// calls this when a reservation of a vehicle type with a deposit is created,
+// while it is still pending. A declined hold can be retried with another card.
+func createDepositHoldHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ReservationID int    `json:"reservation_id"`
+		CardNumber    string `json:"card_number"`
+		ExpiryMonth   int    `json:"expiry_month"`
+		ExpiryYear    int    `json:"expiry_year"`
+		CVC           string `json:"cvc"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || len(input.CardNumber) < 4 {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	d, err := loadReservation(input.ReservationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeReservationAccess(w, r, d.UserID) {
+		return
+	}
+	if d.Status != "pending" && d.Status != "active" {
+		http.Error(w, "Reservation is not active", http.StatusConflict)
+		return
+	}
+
+	amount, err := depositAmount(d)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if !amount.IsPositive() {
+		writeDepositError(w, errNoDepositRequired)
+		return
+	}
+	// The reservation's deposit lock is held while the gateway is called so
+	// that two concurrent requests cannot both hold a deposit on the card
+	tx, err := billingDB.Begin()
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockReservationDeposit(tx, d.ID); err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	var open int
+	err = tx.QueryRow("SELECT COUNT(*) FROM deposit_holds WHERE reservation_id = ? AND status <> ? FOR UPDATE", d.ID, holdDeclined).Scan(&open)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if open > 0 {
+		writeDepositError(w, errDepositHeld)
+		return
+	}
+
+	result, err := paymentGateway.Authorize(ChargeRequest{
+		Amount:      amount,
+		CardNumber:  input.CardNumber,
+		ExpiryMonth: input.ExpiryMonth,
+		ExpiryYear:  input.ExpiryYear,
+		CVC:         input.CVC,
+	})
+	if err != nil {
+		log.Printf("Payment gateway error for deposit of reservation %d: %v", d.ID, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+
+	releaseAfter := d.EndTime.Add(time.Duration(depositReleaseHours) * time.Hour)
+	res, err := tx.Exec(`
+		INSERT INTO deposit_holds (reservation_id, user_id, currency, amount, status, gateway_reference, failure_reason, card_last4, release_after, closed_at)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, IF(?, NOW(), NULL))`,
+		d.ID, d.UserID, amount.Currency, amount, holdStatus(result.Status), result.Reference, result.FailureReason,
+		input.CardNumber[len(input.CardNumber)-4:], releaseAfter.Format(mysqlDateTimeLayout), result.Status == paymentDeclined)
+	if err != nil {
+		log.Printf("Failed to record deposit hold %s of reservation %d: %v", result.Reference, d.ID, err)
+		http.Error(w, "Failed to record deposit hold", http.StatusInternalServerError)
+		return
+	}
+	holdID, _ := res.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to record deposit hold %s of reservation %d: %v", result.Reference, d.ID, err)
+		http.Error(w, "Failed to record deposit hold", http.StatusInternalServerError)
+		return
+	}
+
+	hold, err := scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ?", holdID))
+	if err != nil {
+		http.Error(w, "Failed to fetch deposit hold", http.StatusInternalServerError)
+		return
+	}
+	hold.RedirectURL = result.RedirectURL
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(result.Status))
+	json.NewEncoder(w).Encode(hold)
+}
+
+// lockReservationDeposit takes a per-reservation lock for the rest of the
+// transaction, so holds for the same reservation are placed one at a time. A
+// reservation has no row in this database before its first hold; the lock is
+// its row of deposit_hold_locks.
+func lockReservationDeposit(tx *sql.Tx, reservationID int) error {
+	_, err := tx.Exec("INSERT INTO deposit_hold_locks (reservation_id) VALUES (?) ON DUPLICATE KEY UPDATE reservation_id = reservation_id", reservationID)
+	return err
+}
+
+// loadDepositHold fetches the hold named in the URL and checks the caller may
+// see it. It writes the error response and returns false otherwise.
+func loadDepositHold(w http.ResponseWriter, r *http.Request) (DepositHold, bool) {
+	hold, err := scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ?", mux.Vars(r)["id"]))
+	if err != nil {
+		writeDepositError(w, err)
+		return hold, false
+	}
+	return hold, authorizeReservationAccess(w, r, hold.UserID)
+}
+
+// Complete a deposit hold that is waiting on a 3-D Secure challenge. Holds
+// older than DEPOSIT_CHALLENGE_MINUTES are released instead, with a 409.
+func confirmDepositHoldHandler(w http.ResponseWriter, r *http.Request) {
+	hold, ok := loadDepositHold(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		ChallengeCode string `json:"challenge_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	hold, err = scanDepositHold(tx.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ? FOR UPDATE", hold.ID))
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if hold.Status != holdRequiresAction {
+		http.Error(w, "Deposit hold is not awaiting confirmation", http.StatusConflict)
+		return
+	}
+	// A challenge passed too late does not hold the deposit
+	var expired bool
+	err = tx.QueryRow("SELECT created_at <= NOW() - INTERVAL ? MINUTE FROM deposit_holds WHERE id = ?", depositChallengeMinutes, hold.ID).Scan(&expired)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if expired {
+		if err := paymentGateway.Void(hold.Reference); err != nil {
+			log.Printf("Payment gateway error releasing deposit hold %d: %v", hold.ID, err)
+			http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+			return
+		}
+		if _, err := tx.Exec("UPDATE deposit_holds SET status = ?, closed_at = NOW() WHERE id = ?", holdReleased, hold.ID); err != nil {
+			writeDepositError(w, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeDepositError(w, err)
+			return
+		}
+		writeDepositError(w, errChallengeExpired)
+		return
+	}
+
+	result, err := paymentGateway.Confirm(hold.Reference, input.ChallengeCode)
+	if err != nil {
+		log.Printf("Payment gateway error for deposit hold %d: %v", hold.ID, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+	_, err = tx.Exec("UPDATE deposit_holds SET status = ?, failure_reason = NULLIF(?, ''), closed_at = IF(?, NOW(), NULL) WHERE id = ?",
+		holdStatus(result.Status), result.FailureReason, result.Status == paymentDeclined, hold.ID)
+	if err != nil {
+		http.Error(w, "Failed to record deposit hold", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record deposit hold", http.StatusInternalServerError)
+		return
+	}
+
+	hold, err = scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ?", hold.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch deposit hold", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(result.Status))
+	json.NewEncoder(w).Encode(hold)
+}
+
+// captureDeposit keeps amount of an authorized hold for damages or fees and
+// releases the rest. The capture is posted to the ledger as money received.
+func captureDeposit(holdID int, amount Money, note string) error {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hold, err := scanDepositHold(tx.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ? FOR UPDATE", holdID))
+	if err != nil {
+		return err
+	}
+	if hold.Status != holdAuthorized {
+		return errHoldNotAuthorized
+	}
+	if amount.Currency != hold.Amount.Currency {
+		return errCurrencyMismatch
+	}
+	if !amount.IsPositive() || hold.Amount.LessThan(amount) {
+		return errCaptureExceedsHold
+	}
+
+	reference, err := paymentGateway.Capture(hold.Reference, amount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE deposit_holds SET status = ?, captured_amount = ?, capture_note = ?, closed_at = NOW() WHERE id = ?",
+		holdCaptured, amount, note, hold.ID)
+	if err != nil {
+		return err
+	}
+	err = postLedgerEntry(tx, hold.UserID, 0, ledgerDeposit, fmt.Sprintf("Deposit captured for reservation %d (%s): %s", hold.ReservationID, reference, note),
+		LedgerLine{accountCash, amount},
+		LedgerLine{accountDepositCaptures, amount.Neg()})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Keep part or all of a deposit for damages or fees once the vehicle has been
+// returned. Whatever is not captured is released. Billing staff only.
+func captureDepositHandler(w http.ResponseWriter, r *http.Request) {
+	hold, ok := loadDepositHold(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount *Money `json:"amount"` // defaults to the whole deposit
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if input.Note == "" || len(input.Note) > 255 {
+		http.Error(w, "Note must be between 1 and 255 characters", http.StatusBadRequest)
+		return
+	}
+	amount := hold.Amount
+	if input.Amount != nil {
+		if amount, ok = input.Amount.inCurrency(hold.Amount.Currency); !ok {
+			writeDepositError(w, errCurrencyMismatch)
+			return
+		}
+	}
+
+	var reservationStatus string
+	err := vehicleDB.QueryRow("SELECT status FROM reservations WHERE id = ?", hold.ReservationID).Scan(&reservationStatus)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if reservationStatus != "completed" {
+		http.Error(w, "Deposits can only be captured after the vehicle is returned", http.StatusConflict)
+		return
+	}
+
+	if err := captureDeposit(hold.ID, amount, input.Note); err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	hold, err = scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ?", hold.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch deposit hold", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
+
+// Release a deposit hold without capturing anything. Billing staff only.
+func voidDepositHandler(w http.ResponseWriter, r *http.Request) {
+	hold, ok := loadDepositHold(w, r)
+	if !ok {
+		return
+	}
+	if hold.Status != holdAuthorized && hold.Status != holdRequiresAction {
+		writeDepositError(w, errHoldNotAuthorized)
+		return
+	}
+	if err := releaseHold(hold.ID); err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	hold, err := scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE id = ?", hold.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch deposit hold", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
+
+// Show the latest deposit hold of a reservation
+func getReservationDepositHandler(w http.ResponseWriter, r *http.Request) {
+	hold, err := scanDepositHold(billingDB.QueryRow("SELECT "+depositHoldColumns+" FROM deposit_holds WHERE reservation_id = ? ORDER BY id DESC LIMIT 1", mux.Vars(r)["id"]))
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if !authorizeUserAccess(w, r, hold.UserID) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Company details printed on invoices and receipts
+var (
+	companyName    = getEnv("COMPANY_NAME", "CNAD Car Sharing")
+	companyAddress = getEnv("COMPANY_ADDRESS", "180 Ang Mo Kio Avenue 8, Singapore 569830")
+	companyEmail   = getEnv("COMPANY_EMAIL", "billing@cnad-carsharing.example")
+)
+
+// Layout of the PDF documents, in points
+const (
+	docMargin    = 40.0
+	docLineGap   = 16.0
+	docBottom    = 80.0 // content below this moves to the next page
+	colQuantity  = 360.0
+	colUnitPrice = 455.0
+	colAmount    = pdfPageWidth - docMargin
+)
+
+// wantsPDF reports whether the client asked for a PDF, either with a .pdf URL
+// or an Accept header
+func wantsPDF(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, ".pdf") || strings.Contains(r.Header.Get("Accept"), "application/pdf")
+}
+
+// writePDF sends a rendered document as a download
+func writePDF(w http.ResponseWriter, filename string, pdf []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Write(pdf)
+}
+
+// documentWriter lays out a branded document top to bottom, starting new
+// pages with the same header as it fills up
+type documentWriter struct {
+	*pdfWriter
+	title string
+	y     float64
+}
+
+func newDocument(title string) *documentWriter {
+	d := &documentWriter{pdfWriter: newPDFWriter(), title: title}
+	d.header()
+	return d
+}
+
+// header draws the brand bar with the company name and the document title
+func (d *documentWriter) header() {
+	d.setColor(0.09, 0.27, 0.55)
+	d.fillRect(0, pdfPageHeight-70, pdfPageWidth, 70)
+	d.setColor(1, 1, 1)
+	d.text(docMargin, pdfPageHeight-38, 20, fontBold, companyName)
+	d.text(docMargin, pdfPageHeight-56, 9, fontRegular, companyAddress+"  |  "+companyEmail)
+	d.textRight(colAmount, pdfPageHeight-42, 18, fontBold, d.title)
+	d.setColor(0, 0, 0)
+	d.y = pdfPageHeight - 100
+}
+
+// next moves down by gap, starting a new page when the bottom margin is reached
+func (d *documentWriter) next(gap float64) {
+	d.y -= gap
+	if d.y < docBottom {
+		d.newPage()
+		d.header()
+	}
+}
+
+// field writes a "label: value" row
+func (d *documentWriter) field(label, value string) {
+	d.text(docMargin, d.y, 10, fontBold, label)
+	d.text(docMargin+110, d.y, 10, fontRegular, value)
+	d.next(docLineGap)
+}
+
+// lineItems writes the item table followed by the subtotal, tax and total
+func (d *documentWriter) lineItems(inv Invoice) {
+	d.next(docLineGap / 2)
+	d.text(docMargin, d.y, 10, fontBold, "Description")
+	d.textRight(colQuantity, d.y, 10, fontBold, "Qty")
+	d.textRight(colUnitPrice, d.y, 10, fontBold, "Unit price")
+	d.textRight(colAmount, d.y, 10, fontBold, "Amount")
+	d.line(docMargin, d.y-5, colAmount, d.y-5)
+	d.next(docLineGap + 4)
+
+	for _, item := range inv.LineItems {
+		d.text(docMargin, d.y, 10, fontRegular, item.Description)
+		d.textRight(colQuantity, d.y, 10, fontRegular, fmt.Sprintf("%.2f", item.Quantity))
+		d.textRight(colUnitPrice, d.y, 10, fontRegular, item.UnitPrice.Format())
+		d.textRight(colAmount, d.y, 10, fontRegular, item.Amount.Format())
+		d.next(docLineGap)
+	}
+
+	d.line(colQuantity-60, d.y+10, colAmount, d.y+10)
+	d.next(4)
+	for _, total := range []struct {
+		label  string
+		amount Money
+		font   string
+	}{
+		{"Subtotal", inv.Subtotal, fontRegular},
+		{"Tax", inv.Tax, fontRegular},
+		{"Total", inv.Amount, fontBold},
+	} {
+		d.textRight(colUnitPrice, d.y, 10, total.font, total.label)
+		d.textRight(colAmount, d.y, 10, total.font, total.amount.Format())
+		d.next(docLineGap)
+	}
+}
+
+// footer writes the closing note under the content
+func (d *documentWriter) footer(note string) {
+	d.next(docLineGap)
+	d.setColor(0.4, 0.4, 0.4)
+	d.text(docMargin, d.y, 9, fontRegular, note)
+	d.next(docLineGap)
+	d.text(docMargin, d.y, 9, fontRegular, "Questions about this document? Contact "+companyEmail)
+	d.setColor(0, 0, 0)
+}
+
+// customer writes the bill-to and rental details shared by invoices and receipts
+func (d *documentWriter) customer(inv Invoice) {
+	d.field("Billed to", inv.CustomerName)
+	d.field("Email", inv.CustomerEmail)
+	d.field("Vehicle", strings.TrimSpace(fmt.Sprintf("%s %s (%s)", inv.VehicleMake, inv.VehicleModel, inv.VehicleType)))
+	d.field("Rental period", inv.RentalStart+" to "+inv.RentalEnd)
+}
+
+func renderInvoicePDF(inv Invoice) []byte {
+	d := newDocument("INVOICE")
+	d.field("Invoice number", inv.InvoiceNumber)
+	d.field("Issued", inv.GeneratedDate.Format("2 Jan 2006"))
+	d.field("Billing ID", fmt.Sprint(inv.BillingID))
+	d.field("Reservation ID", fmt.Sprint(inv.ReservationID))
+	d.field("Currency", inv.Currency)
+	d.next(docLineGap / 2)
+	d.customer(inv)
+	d.lineItems(inv)
+	d.footer("Thank you for driving with " + companyName + ".")
+	return d.bytes()
+}
+
+func renderReceiptPDF(receipt Receipt, inv Invoice) []byte {
+	d := newDocument("RECEIPT")
+	d.field("Receipt number", fmt.Sprint(receipt.ReceiptID))
+	d.field("Invoice number", inv.InvoiceNumber)
+	d.field("Payment date", receipt.PaymentDate.Format("2 Jan 2006 15:04"))
+	if receipt.PaymentMethod == methodWallet {
+		d.field("Paid from", "Wallet")
+	} else {
+		d.field("Paid by card", "**** **** **** "+receipt.CardLast4)
+	}
+	d.field("Reference", receipt.PaymentReference)
+	d.next(docLineGap / 2)
+	d.customer(inv)
+	d.lineItems(inv)
+
+	d.setColor(0.1, 0.5, 0.2)
+	d.text(docMargin, d.y, 14, fontBold, "PAID "+receipt.Amount.Format())
+	d.setColor(0, 0, 0)
+	d.next(docLineGap)
+	d.footer("This receipt confirms your payment to " + companyName + ".")
+	return d.bytes()
+}
+
+// Layout of the statement table, in points
+const (
+	colStatementDescription = docMargin + 75
+	colStatementAmount      = colUnitPrice
+)
+
+// renderStatementPDF writes a monthly statement with its running balance
+func renderStatementPDF(s Statement, customerName, customerEmail string) []byte {
+	period, _ := time.ParseInLocation(statementPeriodLayout, s.Period, time.UTC)
+	d := newDocument("STATEMENT")
+	d.field("Statement period", period.Format("January 2006")+" (UTC)")
+	d.field("Currency", s.Currency)
+	d.field("Generated", s.GeneratedAt)
+	d.field("Customer", customerName)
+	d.field("Email", customerEmail)
+
+	d.next(docLineGap / 2)
+	d.text(docMargin, d.y, 10, fontBold, "Date")
+	d.text(colStatementDescription, d.y, 10, fontBold, "Description")
+	d.textRight(colStatementAmount, d.y, 10, fontBold, "Amount")
+	d.textRight(colAmount, d.y, 10, fontBold, "Balance")
+	d.line(docMargin, d.y-5, colAmount, d.y-5)
+	d.next(docLineGap + 4)
+
+	d.text(colStatementDescription, d.y, 10, fontRegular, "Opening balance")
+	d.textRight(colAmount, d.y, 10, fontRegular, s.OpeningBalance.Format())
+	d.next(docLineGap)
+	for _, line := range s.Lines {
+		d.text(docMargin, d.y, 10, fontRegular, strings.SplitN(line.Date, " ", 2)[0])
+		d.text(colStatementDescription, d.y, 10, fontRegular, line.Description)
+		d.textRight(colStatementAmount, d.y, 10, fontRegular, line.Amount.Format())
+		d.textRight(colAmount, d.y, 10, fontRegular, line.Balance.Format())
+		d.next(docLineGap)
+	}
+
+	d.line(colQuantity-60, d.y+10, colAmount, d.y+10)
+	d.next(4)
+	for _, total := range []struct {
+		label  string
+		amount Money
+		font   string
+	}{
+		{"Charges", s.Charges, fontRegular},
+		{"Payments", s.Payments, fontRegular},
+		{"Closing balance", s.ClosingBalance, fontBold},
+		{"Refunds issued", s.Refunds, fontRegular},
+		{"Wallet credits", s.Credits, fontRegular},
+	} {
+		d.textRight(colUnitPrice, d.y, 10, total.font, total.label)
+		d.textRight(colAmount, d.y, 10, total.font, total.amount.Format())
+		d.next(docLineGap)
+	}
+	d.footer("A positive balance is owed to " + companyName + "; a negative one is owed to you.")
+	return d.bytes()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of a dunning case, stored in dunning_cases.status
+const (
+	dunningOpen      = "open"      // the card is retried at next_attempt_at
+	dunningExhausted = "exhausted" // every retry failed; the customer has to pay
+	dunningSettled   = "settled"   // the billing was paid
+	dunningClosed    = "closed"    // the billing is no longer due, e.g. it was voided
+)
+
+// Reminders sent as a dunning case escalates, stored in dunning_reminders.kind
+const (
+	reminderPaymentFailed    = "payment_failed"
+	reminderPaymentReminder  = "payment_reminder"
+	reminderFinalNotice      = "final_notice"      // the next failure makes the account delinquent
+	reminderAccountSuspended = "account_suspended" // the account is delinquent
+)
+
+// Days after the first failed payment that a billing's card is charged again,
+// e.g. "1,3,7". Parsed into dunningSchedule when the service starts.
+var dunningRetryDays = getEnv("DUNNING_RETRY_DAYS", "1,3,7")
+
+var dunningSchedule []time.Duration
+
+// Failed payments of a billing after which its user is delinquent and cannot
+// book vehicles until it is paid
+var dunningDelinquentAfter = getEnvInt("DUNNING_DELINQUENT_AFTER", 3)
+
+// How often due retries are looked for
+const dunningInterval = 15 * time.Minute
+
+// parseRetryDays parses a comma separated list of increasing day counts
+func parseRetryDays(s string) ([]time.Duration, error) {
+	var schedule []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid retry day %q", field)
+		}
+		after := time.Duration(days) * 24 * time.Hour
+		if len(schedule) > 0 && after <= schedule[len(schedule)-1] {
+			return nil, fmt.Errorf("retry days must increase: %s", s)
+		}
+		schedule = append(schedule, after)
+	}
+	return schedule, nil
+}
+
+// DunningCase follows an unpaid billing from its first declined card payment
+// until it is paid
+type DunningCase struct {
+	ID            int               `json:"id"`
+	BillingID     int               `json:"billing_id"`
+	UserID        int               `json:"user_id"`
+	Status        string            `json:"status"`
+	Failures      int               `json:"failures"` // declined payments, the first included
+	Delinquent    bool              `json:"delinquent"`
+	PaymentID     int               `json:"payment_id"` // last declined payment; its card is retried
+	NextAttemptAt string            `json:"next_attempt_at,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+	ClosedAt      string            `json:"closed_at,omitempty"`
+	Reminders     []DunningReminder `json:"reminders"`
+}
+
+// DunningReminder is a message to the customer about an unpaid billing. Rows
+// of dunning_reminders are the outbox the notification sender reads from.
+type DunningReminder struct {
+	ID        int    `json:"id"`
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	CreatedAt string `json:"created_at"`
+}
+
+const dunningCaseColumns = "id, billing_id, user_id, status, failures, delinquent, payment_id, COALESCE(next_attempt_at, ''), created_at, COALESCE(closed_at, '')"
+
+func scanDunningCase(row interface{ Scan(...interface{}) error }) (DunningCase, error) {
+	var c DunningCase
+	err := row.Scan(&c.ID, &c.BillingID, &c.UserID, &c.Status, &c.Failures, &c.Delinquent, &c.PaymentID, &c.NextAttemptAt, &c.CreatedAt, &c.ClosedAt)
+	return c, err
+}
+
+// reminderMessage words a reminder for the amount due on a billing. next is
+// when the card is charged again, or nil when it is not.
+func reminderMessage(kind string, billing Billing, next *time.Time) string {
+	due := billing.Amount.Format()
+	retry := "Please pay it to keep booking vehicles."
+	if next != nil {
+		retry = "We will try your card again on " + next.Format("2 January 2006") + "."
+	}
+	switch kind {
+	case reminderPaymentFailed:
+		return fmt.Sprintf("Your payment of %s for billing %d was declined. %s", due, billing.ID, retry)
+	case reminderFinalNotice:
+		return fmt.Sprintf("Final notice: billing %d of %s is still unpaid. %s If the next attempt fails, you will not be able to book vehicles until it is paid.", billing.ID, due, retry)
+	case reminderAccountSuspended:
+		return fmt.Sprintf("Billing %d of %s is overdue. You cannot book vehicles until it is paid.", billing.ID, due)
+	}
+	return fmt.Sprintf("Billing %d of %s is still unpaid. %s", billing.ID, due, retry)
+}
+
+// recordDunningFailure counts a declined payment of a case inside tx. It
+// schedules the next retry, or ends the retries when the schedule is used up,
+// marks the case delinquent after dunningDelinquentAfter failures or when
+// retries end, and sends the reminder the failure calls for.
+func recordDunningFailure(tx *sql.Tx, c DunningCase, billing Billing, paymentID int) error {
+	openedAt, err := time.ParseInLocation(mysqlDateTimeLayout, c.CreatedAt, time.Local)
+	if err != nil {
+		return err
+	}
+	failures := c.Failures + 1
+
+	status := dunningOpen
+	var next *time.Time
+	if failures <= len(dunningSchedule) {
+		at := openedAt.Add(dunningSchedule[failures-1])
+		next = &at
+	} else {
+		status = dunningExhausted
+	}
+	delinquent := c.Delinquent || failures >= dunningDelinquentAfter || status == dunningExhausted
+
+	kind := reminderPaymentReminder
+	switch {
+	case delinquent && !c.Delinquent:
+		kind = reminderAccountSuspended
+	case failures == 1:
+		kind = reminderPaymentFailed
+	case !delinquent && failures == dunningDelinquentAfter-1:
+		kind = reminderFinalNotice
+	}
+
+	var nextAttemptAt interface{}
+	if next != nil {
+		nextAttemptAt = next.Format(mysqlDateTimeLayout)
+	}
+	_, err = tx.Exec("UPDATE dunning_cases SET status = ?, failures = ?, delinquent = ?, payment_id = ?, next_attempt_at = ? WHERE id = ?",
+		status, failures, delinquent, paymentID, nextAttemptAt, c.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO dunning_reminders (case_id, user_id, kind, message) VALUES (?, ?, ?, ?)",
+		c.ID, c.UserID, kind, reminderMessage(kind, billing, next))
+	if err != nil {
+		return err
+	}
+	log.Printf("Sent %s reminder to user %d for billing %d", kind, c.UserID, billing.ID)
+	return nil
+}
+
+// openDunning starts dunning for a billing whose card payment was declined,
+// inside tx. If a case is already open, the card of the new payment is the
+// one retried from now on.
+func openDunning(tx *sql.Tx, billing Billing, paymentID int) error {
+	c, err := scanDunningCase(tx.QueryRow("SELECT "+dunningCaseColumns+" FROM dunning_cases WHERE billing_id = ? FOR UPDATE", billing.ID))
+	if err == nil {
+		_, err = tx.Exec("UPDATE dunning_cases SET payment_id = ? WHERE id = ?", paymentID, c.ID)
+		return err
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	res, err := tx.Exec("INSERT INTO dunning_cases (billing_id, user_id, status, payment_id) VALUES (?, ?, ?, ?)",
+		billing.ID, billing.UserID, dunningOpen, paymentID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c, err = scanDunningCase(tx.QueryRow("SELECT "+dunningCaseColumns+" FROM dunning_cases WHERE id = ?", id))
+	if err != nil {
+		return err
+	}
+	return recordDunningFailure(tx, c, billing, paymentID)
+}
+
+// settleDunning closes the case of a billing that was paid, inside tx
+func settleDunning(tx *sql.Tx, billingID int) error {
+	_, err := tx.Exec("UPDATE dunning_cases SET status = ?, next_attempt_at = NULL, closed_at = NOW() WHERE billing_id = ? AND status IN (?, ?)",
+		dunningSettled, billingID, dunningOpen, dunningExhausted)
+	return err
+}
+
+// retryPayment charges the card of a case's last declined payment again for
+// what the billing now comes to, recording the attempt like any other payment
+func retryPayment(caseID int) error {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	c, err := scanDunningCase(tx.QueryRow("SELECT "+dunningCaseColumns+" FROM dunning_cases WHERE id = ? FOR UPDATE", caseID))
+	if err != nil {
+		return err
+	}
+	if c.Status != dunningOpen {
+		return nil
+	}
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ? FOR UPDATE", c.BillingID))
+	if err != nil {
+		return err
+	}
+	if billing.PaymentStatus != billingPending {
+		if _, err := tx.Exec("UPDATE dunning_cases SET status = ?, next_attempt_at = NULL, closed_at = NOW() WHERE id = ?", dunningClosed, c.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if billing, err = addOvertime(tx, billing); err != nil {
+		return err
+	}
+	last, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", c.PaymentID))
+	if err != nil {
+		return err
+	}
+
+	result, err := paymentGateway.Retry(last.CardToken, billing.Amount)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO payments (billing_id, currency, amount, status, gateway_reference, failure_reason, card_last4, card_token, completed_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), NOW())`,
+		billing.ID, billing.Amount.Currency, billing.Amount, result.Status, result.Reference, result.FailureReason, last.CardLast4, last.CardToken)
+	if err != nil {
+		return err
+	}
+	paymentID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if result.Status == paymentSucceeded {
+		err = markBillingPaid(tx, billing, accountCash, result.Reference)
+	} else {
+		err = recordDunningFailure(tx, c, billing, int(paymentID))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryDuePayments retries every open case whose next attempt is due
+func retryDuePayments() {
+	rows, err := billingDB.Query("SELECT id FROM dunning_cases WHERE status = ? AND next_attempt_at <= NOW()", dunningOpen)
+	if err != nil {
+		log.Printf("Failed to look for due payment retries: %v", err)
+		return
+	}
+	var caseIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Failed to read dunning case: %v", err)
+			break
+		}
+		caseIDs = append(caseIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range caseIDs {
+		if err := retryPayment(id); err != nil {
+			log.Printf("Failed to retry payment of dunning case %d: %v", id, err)
+		}
+	}
+}
+
+// retryDuePaymentsEvery runs retryDuePayments now and then at every interval.
+// It never returns.
+func retryDuePaymentsEvery(interval time.Duration) {
+	for {
+		retryDuePayments()
+		time.Sleep(interval)
+	}
+}
+
+// Show a user's dunning cases with their reminders, newest first, and whether
+// the user is delinquent. A delinquent user cannot book vehicles until every
+// billing that made them delinquent is paid.
+func getDunningHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeUserAccess(w, r, userID) {
+		return
+	}
+
+	rows, err := billingDB.Query("SELECT "+dunningCaseColumns+" FROM dunning_cases WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch dunning cases", http.StatusInternalServerError)
+		return
+	}
+	cases := []DunningCase{}
+	for rows.Next() {
+		c, err := scanDunningCase(rows)
+		if err != nil {
+			rows.Close()
+			http.Error(w, "Failed to parse dunning case data", http.StatusInternalServerError)
+			return
+		}
+		cases = append(cases, c)
+	}
+	rows.Close()
+
+	for i := range cases {
+		if cases[i].Reminders, err = loadReminders(cases[i].ID); err != nil {
+			http.Error(w, "Failed to fetch reminders", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var delinquent int
+	err = billingDB.QueryRow(`
+		SELECT COUNT(*) FROM dunning_cases d JOIN billings b ON b.id = d.billing_id
+		WHERE d.user_id = ? AND d.delinquent AND b.payment_status = ?`, userID, billingPending).Scan(&delinquent)
+	if err != nil {
+		http.Error(w, "Failed to fetch dunning cases", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":    userID,
+		"delinquent": delinquent > 0,
+		"cases":      cases,
+	})
+}
+
+func loadReminders(caseID int) ([]DunningReminder, error) {
+	rows, err := billingDB.Query("SELECT id, kind, message, created_at FROM dunning_reminders WHERE case_id = ? ORDER BY id", caseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reminders := []DunningReminder{}
+	for rows.Next() {
+		var reminder DunningReminder
+		if err := rows.Scan(&reminder.ID, &reminder.Kind, &reminder.Message, &reminder.CreatedAt); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, reminder)
+	}
+	return reminders, rows.Err()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CSV file of exchange rates loaded at startup, if set. Each line is
+// from_currency,to_currency,rate; a header line is optional.
+var exchangeRatesFile = getEnv("EXCHANGE_RATES_FILE", "")
+
+// Layout of the from and to dates of reports
+const reportDateLayout = "2006-01-02"
+
+var errNoExchangeRate = errors.New("no exchange rate")
+
+// ExchangeRate converts From into To: one unit of From is worth Rate units of To
+type ExchangeRate struct {
+	From      string `json:"from_currency"`
+	To        string `json:"to_currency"`
+	Rate      string `json:"rate"` // decimal string, like amounts
+	UpdatedAt string `json:"updated_at"`
+}
+
+const exchangeRateColumns = "from_currency, to_currency, rate, updated_at"
+
+func scanExchangeRate(row interface{ Scan(...interface{}) error }) (ExchangeRate, error) {
+	var e ExchangeRate
+	err := row.Scan(&e.From, &e.To, &e.Rate, &e.UpdatedAt)
+	return e, err
+}
+
+// loadExchangeRates stores every rate in a CSV file, replacing existing rates
+// for the same pair. Nothing is stored if any line is invalid.
+func loadExchangeRates(r io.Reader) (int, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	if len(records) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "from_currency") {
+		records = records[1:]
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for i, record := range records {
+		if len(record) != 3 {
+			return 0, fmt.Errorf("line %d: expected from_currency,to_currency,rate", i+1)
+		}
+		from, to := strings.ToUpper(strings.TrimSpace(record[0])), strings.ToUpper(strings.TrimSpace(record[1]))
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(record[2]))
+		switch {
+		case !isCurrencyCode(from) || !isCurrencyCode(to) || from == to:
+			return 0, fmt.Errorf("line %d: invalid currency pair %s/%s", i+1, record[0], record[1])
+		case !ok || rate.Sign() <= 0:
+			return 0, fmt.Errorf("line %d: invalid rate %q", i+1, record[2])
+		}
+		_, err := tx.Exec(`
+			INSERT INTO exchange_rates (from_currency, to_currency, rate) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE rate = VALUES(rate)`,
+			from, to, rate.FloatString(8))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(records), tx.Commit()
+}
+
+// loadExchangeRatesFile loads EXCHANGE_RATES_FILE
+func loadExchangeRatesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := loadExchangeRates(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d exchange rates from %s", n, path)
+	return nil
+}
+
+// exchangeRate returns how many units of to one unit of from is worth, using
+// the inverse of the opposite pair when only that one is known
+func exchangeRate(from, to string) (*big.Rat, error) {
+	var rate string
+	err := billingDB.QueryRow("SELECT rate FROM exchange_rates WHERE from_currency = ? AND to_currency = ?", from, to).Scan(&rate)
+	inverse := false
+	if err == sql.ErrNoRows {
+		err = billingDB.QueryRow("SELECT rate FROM exchange_rates WHERE from_currency = ? AND to_currency = ?", to, from).Scan(&rate)
+		inverse = true
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w from %s to %s", errNoExchangeRate, from, to)
+	} else if err != nil {
+		return nil, err
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid exchange rate %q from %s to %s", rate, from, to)
+	}
+	if inverse {
+		r.Inv(r)
+	}
+	return r, nil
+}
+
+// convertMoney converts an amount into another currency at the stored rate,
+// rounding half away from zero to the minor unit of that currency
+func convertMoney(m Money, currency string) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	rate, err := exchangeRate(m.Currency, currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	converted := new(big.Rat).SetInt64(m.Minor)
+	converted.Mul(converted, rate)
+	converted.Mul(converted, new(big.Rat).SetInt64(minorUnitsPerMajor(currency)))
+	converted.Quo(converted, new(big.Rat).SetInt64(minorUnitsPerMajor(m.Currency)))
+
+	// Round half away from zero: (2|num| + den) / 2den, with the sign of num
+	num := new(big.Int).Abs(converted.Num())
+	den := converted.Denom()
+	num.Add(num.Lsh(num, 1), den)
+	minor := num.Quo(num, new(big.Int).Lsh(den, 1))
+	if converted.Sign() < 0 {
+		minor.Neg(minor)
+	}
+	if !minor.IsInt64() {
+		return Money{}, fmt.Errorf("converted amount out of range")
+	}
+	return Money{Minor: minor.Int64(), Currency: currency}, nil
+}
+
+func getExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rows, err := billingDB.Query("SELECT " + exchangeRateColumns + " FROM exchange_rates ORDER BY from_currency, to_currency")
+	if err != nil {
+		http.Error(w, "Failed to fetch exchange rates", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		e, err := scanExchangeRate(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse exchange rate data", http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, e)
+	}
+	json.NewEncoder(w).Encode(rates)
+}
+
+// Load exchange rates from a CSV file sent as the request body, in the same
+// format as EXCHANGE_RATES_FILE
+func importExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	n, err := loadExchangeRates(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid exchange rate file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"loaded": n})
+}
+
+// CurrencyTotals are the money movements of a report in one billing currency
+type CurrencyTotals struct {
+	Currency  string `json:"currency"`
+	Billed    Money  `json:"billed"`
+	Collected Money  `json:"collected"`
+	Refunded  Money  `json:"refunded"`
+}
+
+// RevenueReport totals billings, payments and refunds over a period in each
+// currency they were made in, and converted into a single reporting currency
+type RevenueReport struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Currency   string           `json:"currency"`
+	ByCurrency []CurrencyTotals `json:"by_currency"`
+	Billed     Money            `json:"billed"`
+	Collected  Money            `json:"collected"`
+	Refunded   Money            `json:"refunded"`
+}
+
+// sumByCurrency runs a query returning currency and amount rows
+func sumByCurrency(query string, args ...interface{}) (map[string]Money, error) {
+	rows, err := billingDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[string]Money{}
+	for rows.Next() {
+		var currency string
+		var amount moneyColumn
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		if sums[currency], err = amount.money(currency); err != nil {
+			return nil, err
+		}
+	}
+	return sums, rows.Err()
+}
+
+// Report revenue between two dates (inclusive, YYYY-MM-DD) converted into
+// ?currency=, which defaults to the default currency. The period defaults to
+// the current month.
+func getRevenueReportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	report := RevenueReport{
+		From:     query.Get("from"),
+		To:       query.Get("to"),
+		Currency: strings.ToUpper(query.Get("currency")),
+	}
+	if report.From == "" {
+		report.From = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).Format(reportDateLayout)
+	}
+	if report.To == "" {
+		report.To = now.Format(reportDateLayout)
+	}
+	if report.Currency == "" {
+		report.Currency = defaultCurrency
+	}
+	if !isCurrencyCode(report.Currency) {
+		http.Error(w, "Invalid currency", http.StatusBadRequest)
+		return
+	}
+	from, err := time.ParseInLocation(reportDateLayout, report.From, time.Local)
+	if err != nil {
+		http.Error(w, "From date must be in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+	to, err := time.ParseInLocation(reportDateLayout, report.To, time.Local)
+	if err != nil {
+		http.Error(w, "To date must be in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+	start, end := from.Format(mysqlDateTimeLayout), to.AddDate(0, 0, 1).Format(mysqlDateTimeLayout)
+
+	billed, err := sumByCurrency("SELECT currency, SUM(amount) FROM billings WHERE payment_status <> ? AND created_at >= ? AND created_at < ? GROUP BY currency",
+		billingVoid, start, end)
+	if err != nil {
+		http.Error(w, "Failed to total billings", http.StatusInternalServerError)
+		return
+	}
+	collected, err := sumByCurrency("SELECT currency, SUM(amount) FROM payments WHERE status = ? AND completed_at >= ? AND completed_at < ? GROUP BY currency",
+		paymentSucceeded, start, end)
+	if err != nil {
+		http.Error(w, "Failed to total payments", http.StatusInternalServerError)
+		return
+	}
+	refunded, err := sumByCurrency("SELECT currency, SUM(amount) FROM refunds WHERE created_at >= ? AND created_at < ? GROUP BY currency", start, end)
+	if err != nil {
+		http.Error(w, "Failed to total refunds", http.StatusInternalServerError)
+		return
+	}
+
+	currencies := map[string]bool{}
+	for _, sums := range []map[string]Money{billed, collected, refunded} {
+		for currency := range sums {
+			currencies[currency] = true
+		}
+	}
+	report.ByCurrency = []CurrencyTotals{}
+	for currency := range currencies {
+		totals := CurrencyTotals{Currency: currency, Billed: zeroMoney(currency), Collected: zeroMoney(currency), Refunded: zeroMoney(currency)}
+		if m, ok := billed[currency]; ok {
+			totals.Billed = m
+		}
+		if m, ok := collected[currency]; ok {
+			totals.Collected = m
+		}
+		if m, ok := refunded[currency]; ok {
+			totals.Refunded = m
+		}
+		report.ByCurrency = append(report.ByCurrency, totals)
+	}
+	sort.Slice(report.ByCurrency, func(i, j int) bool { return report.ByCurrency[i].Currency < report.ByCurrency[j].Currency })
+
+	report.Billed, report.Collected, report.Refunded = zeroMoney(report.Currency), zeroMoney(report.Currency), zeroMoney(report.Currency)
+	for _, totals := range report.ByCurrency {
+		for _, t := range []struct {
+			sum    *Money
+			amount Money
+		}{{&report.Billed, totals.Billed}, {&report.Collected, totals.Collected}, {&report.Refunded, totals.Refunded}} {
+			converted, err := convertMoney(t.amount, report.Currency)
+			if errors.Is(err, errNoExchangeRate) {
+				http.Error(w, fmt.Sprintf("No exchange rate from %s to %s", totals.Currency, report.Currency), http.StatusUnprocessableEntity)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to convert totals", http.StatusInternalServerError)
+				return
+			}
+			*t.sum = t.sum.Add(converted)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// Outcomes of a charge attempt, stored in payments.status
+const (
+	paymentSucceeded      = "succeeded"
+	paymentDeclined       = "declined"
+	paymentRequiresAction = "requires_action"
+)
+
+// ChargeRequest is a single attempt to charge a card for a billing, or for a
+// wallet top-up or deposit hold when BillingID is 0
+type ChargeRequest struct {
+	BillingID   int
+	Amount      Money
+	CardNumber  string
+	ExpiryMonth int
+	ExpiryYear  int
+	CVC         string
+}
+
+// ChargeResult is the gateway's answer to a charge, an authorization or a 3-D
+// Secure confirmation. An authorization that succeeds is a hold on the card.
+type ChargeResult struct {
+	Status        string
+	Reference     string // gateway transaction id
+	FailureReason string
+	RedirectURL   string // where the customer completes a 3-D Secure challenge
+	CardToken     string // the provider's reusable token for the card, never the card number
+}
+
+// PaymentGateway is implemented by each payment provider the billing service can use
+type PaymentGateway interface {
+	// Charge attempts to take the full amount from the card
+	Charge(req ChargeRequest) (ChargeResult, error)
+	// Confirm completes a charge that returned paymentRequiresAction
+	Confirm(reference, challengeCode string) (ChargeResult, error)
+	// Refund returns part or all of a succeeded charge and gives the refund's reference
+	Refund(reference string, amount Money) (string, error)
+	// Authorize places a hold of the full amount on the card without taking it.
+	// Pending 3-D Secure challenges are completed with Confirm.
+	Authorize(req ChargeRequest) (ChargeResult, error)
+	// Capture takes part or all of a hold, releases the rest and gives the capture's reference
+	Capture(reference string, amount Money) (string, error)
+	// Void releases a hold without taking anything
+	Void(reference string) error
+	// Retry charges the card behind the CardToken of an earlier charge again
+	// without the customer present, for dunning. It never asks for a 3-D
+	// Secure challenge.
+	Retry(cardToken string, amount Money) (ChargeResult, error)
+}
+
+// Gateway used by the payment endpoints. Replace with a real provider in production.
+var paymentGateway PaymentGateway = fakeGateway{}
+
+// Card numbers with a fixed outcome on the fake gateway
+const (
+	fakeCardSuccess           = "4242424242424242"
+	fakeCardDeclined          = "4000000000000002"
+	fakeCardInsufficientFunds = "4000000000009995"
+	fakeCardChallenge         = "4000000000003220"
+	fakeChallengeCode         = "123456"
+)
+
+// fakeGateway is a deterministic gateway for development and tests. It never
+// contacts a provider; the outcome depends only on the card number, and a
+// 3-D Secure challenge passes only with fakeChallengeCode.
+type fakeGateway struct{}
+
+// Card tokens of the fake gateway. Each test card has a fixed token that
+// stands for its outcome, so tokens survive restarts and hold no card data.
+const (
+	fakeTokenSuccess           = "tok_success"
+	fakeTokenDeclined          = "tok_declined"
+	fakeTokenInsufficientFunds = "tok_insufficient_funds"
+	fakeTokenChallenge         = "tok_challenge"
+	fakeTokenUnsupported       = "tok_unsupported"
+)
+
+// fakeCardToken is the token the fake gateway issues for a card number
+func fakeCardToken(cardNumber string) string {
+	switch strings.ReplaceAll(cardNumber, " ", "") {
+	case fakeCardSuccess:
+		return fakeTokenSuccess
+	case fakeCardDeclined:
+		return fakeTokenDeclined
+	case fakeCardInsufficientFunds:
+		return fakeTokenInsufficientFunds
+	case fakeCardChallenge:
+		return fakeTokenChallenge
+	}
+	return fakeTokenUnsupported
+}
+
+func (fakeGateway) Charge(req ChargeRequest) (ChargeResult, error) {
+	return fakeCharge(fakeCardToken(req.CardNumber))
+}
+
+// fakeCharge charges the card behind a fake token
+func fakeCharge(cardToken string) (ChargeResult, error) {
+	reference, err := fakeReference()
+	if err != nil {
+		return ChargeResult{}, err
+	}
+
+	switch cardToken {
+	case fakeTokenSuccess:
+		return ChargeResult{Status: paymentSucceeded, Reference: reference, CardToken: cardToken}, nil
+	case fakeTokenDeclined:
+		return ChargeResult{Status: paymentDeclined, Reference: reference, FailureReason: "card_declined", CardToken: cardToken}, nil
+	case fakeTokenInsufficientFunds:
+		return ChargeResult{Status: paymentDeclined, Reference: reference, FailureReason: "insufficient_funds", CardToken: cardToken}, nil
+	case fakeTokenChallenge:
+		return ChargeResult{Status: paymentRequiresAction, Reference: reference, RedirectURL: "https://fake-gateway.local/3ds/" + reference, CardToken: cardToken}, nil
+	case fakeTokenUnsupported:
+		return ChargeResult{Status: paymentDeclined, Reference: reference, FailureReason: "card_not_supported", CardToken: cardToken}, nil
+	}
+	return ChargeResult{Status: paymentDeclined, Reference: reference, FailureReason: "unknown_card_token"}, nil
+}
+
+func (fakeGateway) Confirm(reference, challengeCode string) (ChargeResult, error) {
+	if challengeCode != fakeChallengeCode {
+		return ChargeResult{Status: paymentDeclined, Reference: reference, FailureReason: "authentication_failed"}, nil
+	}
+	return ChargeResult{Status: paymentSucceeded, Reference: reference}, nil
+}
+
+func (fakeGateway) Refund(reference string, amount Money) (string, error) {
+	return fakeReference()
+}
+
+// Authorize has the same outcomes as Charge
+func (g fakeGateway) Authorize(req ChargeRequest) (ChargeResult, error) {
+	return g.Charge(req)
+}
+
+func (fakeGateway) Capture(reference string, amount Money) (string, error) {
+	return fakeReference()
+}
+
+func (fakeGateway) Void(reference string) error {
+	return nil
+}
+
+// Retry has the outcome of a new charge of the same card, except that cards
+// needing a challenge are declined
+func (fakeGateway) Retry(cardToken string, amount Money) (ChargeResult, error) {
+	result, err := fakeCharge(cardToken)
+	if err == nil && result.Status == paymentRequiresAction {
+		result = ChargeResult{Status: paymentDeclined, Reference: result.Reference, FailureReason: "authentication_required", CardToken: cardToken}
+	}
+	return result, err
+}
+
+func fakeReference() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "fake_" + hex.EncodeToString(buf), nil
+}
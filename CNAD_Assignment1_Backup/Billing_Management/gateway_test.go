@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testAmount() Money {
+	return Money{Minor: 1234, Currency: "SGD"}
+}
+
+func TestFakeGatewayCharge(t *testing.T) {
+	tests := []struct {
+		card          string
+		status        string
+		failureReason string
+		token         string
+	}{
+		{fakeCardSuccess, paymentSucceeded, "", fakeTokenSuccess},
+		{"4242 4242 4242 4242", paymentSucceeded, "", fakeTokenSuccess},
+		{fakeCardDeclined, paymentDeclined, "card_declined", fakeTokenDeclined},
+		{fakeCardInsufficientFunds, paymentDeclined, "insufficient_funds", fakeTokenInsufficientFunds},
+		{fakeCardChallenge, paymentRequiresAction, "", fakeTokenChallenge},
+		{"5555555555554444", paymentDeclined, "card_not_supported", fakeTokenUnsupported},
+	}
+	for _, tt := range tests {
+		result, err := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: tt.card})
+		if err != nil {
+			t.Fatalf("Charge(%s): %v", tt.card, err)
+		}
+		if result.Status != tt.status || result.FailureReason != tt.failureReason {
+			t.Errorf("Charge(%s) = %s %q, want %s %q", tt.card, result.Status, result.FailureReason, tt.status, tt.failureReason)
+		}
+		if result.CardToken != tt.token {
+			t.Errorf("Charge(%s) card token = %q, want %q", tt.card, result.CardToken, tt.token)
+		}
+		if strings.Contains(result.CardToken, strings.ReplaceAll(tt.card, " ", "")) {
+			t.Errorf("Charge(%s) card token %q contains the card number", tt.card, result.CardToken)
+		}
+		if !strings.HasPrefix(result.Reference, "fake_") {
+			t.Errorf("Charge(%s) reference = %q, want a fake_ reference", tt.card, result.Reference)
+		}
+		if (tt.status == paymentRequiresAction) != (result.RedirectURL != "") {
+			t.Errorf("Charge(%s) redirect URL = %q", tt.card, result.RedirectURL)
+		}
+	}
+}
+
+func TestFakeGatewayReferencesAreUnique(t *testing.T) {
+	first, _ := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardSuccess})
+	second, _ := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardSuccess})
+	if first.Reference == second.Reference {
+		t.Errorf("two charges share reference %s", first.Reference)
+	}
+}
+
+func TestFakeGatewayConfirm(t *testing.T) {
+	charge, _ := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardChallenge})
+
+	result, err := fakeGateway{}.Confirm(charge.Reference, fakeChallengeCode)
+	if err != nil || result.Status != paymentSucceeded || result.Reference != charge.Reference {
+		t.Errorf("Confirm with the right code = %+v, %v", result, err)
+	}
+	result, err = fakeGateway{}.Confirm(charge.Reference, "000000")
+	if err != nil || result.Status != paymentDeclined || result.FailureReason != "authentication_failed" {
+		t.Errorf("Confirm with a wrong code = %+v, %v", result, err)
+	}
+}
+
+func TestFakeGatewayAuthorize(t *testing.T) {
+	result, err := fakeGateway{}.Authorize(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardSuccess})
+	if err != nil || result.Status != paymentSucceeded {
+		t.Errorf("Authorize = %+v, %v", result, err)
+	}
+	result, err = fakeGateway{}.Authorize(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardDeclined})
+	if err != nil || result.Status != paymentDeclined {
+		t.Errorf("Authorize of a declined card = %+v, %v", result, err)
+	}
+}
+
+func TestFakeGatewayRefundCaptureVoid(t *testing.T) {
+	charge, _ := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: fakeCardSuccess})
+
+	refund, err := fakeGateway{}.Refund(charge.Reference, testAmount())
+	if err != nil || refund == "" || refund == charge.Reference {
+		t.Errorf("Refund = %q, %v", refund, err)
+	}
+	capture, err := fakeGateway{}.Capture(charge.Reference, testAmount())
+	if err != nil || capture == "" || capture == charge.Reference {
+		t.Errorf("Capture = %q, %v", capture, err)
+	}
+	if err := (fakeGateway{}).Void(charge.Reference); err != nil {
+		t.Errorf("Void: %v", err)
+	}
+}
+
+func TestFakeGatewayRetry(t *testing.T) {
+	tests := []struct {
+		card          string
+		status        string
+		failureReason string
+	}{
+		{fakeCardSuccess, paymentSucceeded, ""},
+		{fakeCardInsufficientFunds, paymentDeclined, "insufficient_funds"},
+		// Nobody is present to pass a challenge
+		{fakeCardChallenge, paymentDeclined, "authentication_required"},
+	}
+	for _, tt := range tests {
+		charge, _ := fakeGateway{}.Charge(ChargeRequest{Amount: testAmount(), CardNumber: tt.card})
+		// A new gateway value stands in for a restart; the token is all Retry needs
+		result, err := fakeGateway{}.Retry(charge.CardToken, testAmount())
+		if err != nil {
+			t.Fatalf("Retry(%s): %v", charge.CardToken, err)
+		}
+		if result.Status != tt.status || result.FailureReason != tt.failureReason {
+			t.Errorf("Retry(%s) = %s %q, want %s %q", charge.CardToken, result.Status, result.FailureReason, tt.status, tt.failureReason)
+		}
+		if result.Reference == charge.Reference {
+			t.Errorf("Retry(%s) reused reference %s", charge.CardToken, result.Reference)
+		}
+		if result.CardToken != charge.CardToken {
+			t.Errorf("Retry(%s) card token = %q", charge.CardToken, result.CardToken)
+		}
+	}
+}
+
+func TestFakeGatewayRetryUnknownToken(t *testing.T) {
+	for _, token := range []string{"", "tok_missing", fakeCardSuccess} {
+		result, err := fakeGateway{}.Retry(token, testAmount())
+		if err != nil {
+			t.Fatalf("Retry(%q): %v", token, err)
+		}
+		if result.Status != paymentDeclined || result.FailureReason != "unknown_card_token" {
+			t.Errorf("Retry(%q) = %s %q, want declined unknown_card_token", token, result.Status, result.FailureReason)
+		}
+	}
+}
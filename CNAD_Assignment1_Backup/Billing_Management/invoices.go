@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of invoice line item, stored in invoice_line_items.kind
+const (
+	lineRental     = "rental"
+	lineDiscount   = "discount"
+	linePromotion  = "promotion"
+	lineAdjustment = "adjustment"
+	lineFee        = "fee"
+	lineOvertime   = "overtime"
+	lineTax        = "tax"
+)
+
+var errBillingNotFinal = errors.New("billing is not final yet")
+
+// Invoice is issued once per billing and never changes afterwards
+type Invoice struct {
+	InvoiceID     int               `json:"invoice_id"`
+	InvoiceNumber string            `json:"invoice_number"`
+	BillingID     int               `json:"billing_id"`
+	ReservationID int               `json:"reservation_id"`
+	CustomerName  string            `json:"customer_name"`
+	CustomerEmail string            `json:"customer_email"`
+	VehicleMake   string            `json:"vehicle_make"`
+	VehicleModel  string            `json:"vehicle_model"`
+	VehicleType   string            `json:"vehicle_type"`
+	RentalStart   string            `json:"rental_start"`
+	RentalEnd     string            `json:"rental_end"`
+	LineItems     []InvoiceLineItem `json:"line_items"`
+	Currency      string            `json:"currency"` // of the totals and line items
+	Subtotal      Money             `json:"subtotal"`
+	Tax           Money             `json:"tax"`
+	Amount        Money             `json:"amount"` // total due
+	GeneratedDate time.Time         `json:"generated_date"`
+}
+
+// InvoiceLineItem is one row of an invoice. Discounts have a negative amount.
+type InvoiceLineItem struct {
+	Kind        string  `json:"kind"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   Money   `json:"unit_price"`
+	Amount      Money   `json:"amount"`
+}
+
+const invoiceColumns = `id, invoice_number, billing_id, reservation_id, customer_name, customer_email, vehicle_make, vehicle_model,
+	vehicle_type, rental_start, rental_end, currency, subtotal, tax, total, issued_at`
+
+func scanInvoice(row interface{ Scan(...interface{}) error }) (Invoice, error) {
+	var inv Invoice
+	var issuedAt string
+	var subtotal, tax, total moneyColumn
+	err := row.Scan(&inv.InvoiceID, &inv.InvoiceNumber, &inv.BillingID, &inv.ReservationID, &inv.CustomerName, &inv.CustomerEmail,
+		&inv.VehicleMake, &inv.VehicleModel, &inv.VehicleType, &inv.RentalStart, &inv.RentalEnd, &inv.Currency, &subtotal, &tax, &total, &issuedAt)
+	if err != nil {
+		return inv, err
+	}
+	if inv.Subtotal, err = subtotal.money(inv.Currency); err != nil {
+		return inv, err
+	}
+	if inv.Tax, err = tax.money(inv.Currency); err != nil {
+		return inv, err
+	}
+	if inv.Amount, err = total.money(inv.Currency); err != nil {
+		return inv, err
+	}
+	inv.GeneratedDate, err = time.ParseInLocation(mysqlDateTimeLayout, issuedAt, time.Local)
+	return inv, err
+}
+
+// loadInvoice returns the invoice of a billing with its line items
+func loadInvoice(billingID int) (Invoice, error) {
+	inv, err := scanInvoice(billingDB.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE billing_id = ?", billingID))
+	if err != nil {
+		return inv, err
+	}
+
+	rows, err := billingDB.Query("SELECT kind, description, quantity, unit_price, amount FROM invoice_line_items WHERE invoice_id = ? ORDER BY id", inv.InvoiceID)
+	if err != nil {
+		return inv, err
+	}
+	defer rows.Close()
+
+	inv.LineItems = []InvoiceLineItem{}
+	for rows.Next() {
+		var item InvoiceLineItem
+		var unitPrice, amount moneyColumn
+		if err := rows.Scan(&item.Kind, &item.Description, &item.Quantity, &unitPrice, &amount); err != nil {
+			return inv, err
+		}
+		if item.UnitPrice, err = unitPrice.money(inv.Currency); err != nil {
+			return inv, err
+		}
+		if item.Amount, err = amount.money(inv.Currency); err != nil {
+			return inv, err
+		}
+		inv.LineItems = append(inv.LineItems, item)
+	}
+	return inv, rows.Err()
+}
+
+// invoiceLineItems itemises a billing: the rental at the base rate, the
+// membership discount and promotion, any late return charge, an adjustment for anything else that
+// changed the price, such as a quoted price or a cancellation, and the tax.
+// Inclusive tax is listed for information; it is already part of the other lines.
+func invoiceLineItems(d reservationDetails, billing Billing) ([]InvoiceLineItem, error) {
+	// Itemise in the currency that was billed
+	d.Currency = billing.Amount.Currency
+	hourlyRate, err := getVehiclePricing(d.VehicleType, d.Currency)
+	if err != nil {
+		return nil, err
+	}
+	base, err := reservationBaseCost(d)
+	if err != nil {
+		return nil, err
+	}
+	cost, err := reservationCost(d)
+	if err != nil {
+		return nil, err
+	}
+
+	hours := d.EndTime.Sub(d.StartTime).Hours()
+	items := []InvoiceLineItem{{
+		Kind:        lineRental,
+		Description: fmt.Sprintf("%s rental, %.2f hours", d.VehicleType, hours),
+		Quantity:    hours,
+		UnitPrice:   hourlyRate,
+		Amount:      base,
+	}}
+	if discount := base.Sub(cost); discount.IsPositive() {
+		items = append(items, InvoiceLineItem{
+			Kind:        lineDiscount,
+			Description: d.MembershipTier + " membership discount",
+			Quantity:    1,
+			UnitPrice:   discount.Neg(),
+			Amount:      discount.Neg(),
+		})
+	}
+
+	var code string
+	var discountAmount moneyColumn
+	err = billingDB.QueryRow(`
+		SELECT p.code, r.discount_amount
+		FROM promotion_redemptions r
+		JOIN promotions p ON p.id = r.promotion_id
+		WHERE r.billing_id = ?`, billing.ID).Scan(&code, &discountAmount)
+	if err == nil {
+		promoDiscount, err := discountAmount.money(billing.Amount.Currency)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, InvoiceLineItem{
+			Kind:        linePromotion,
+			Description: "Promotion " + code,
+			Quantity:    1,
+			UnitPrice:   promoDiscount.Neg(),
+			Amount:      promoDiscount.Neg(),
+		})
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if billing.OvertimeFee != nil && billing.OvertimeFee.IsPositive() {
+		items = append(items, InvoiceLineItem{
+			Kind:        lineOvertime,
+			Description: overtimeDescription(billing.OvertimeMinutes),
+			Quantity:    1,
+			UnitPrice:   *billing.OvertimeFee,
+			Amount:      *billing.OvertimeFee,
+		})
+	}
+
+	total := zeroMoney(billing.Amount.Currency)
+	for _, item := range items {
+		total = total.Add(item.Amount)
+	}
+	if adjustment := billing.preTaxAmount().Sub(total); !adjustment.IsZero() {
+		description := "Quoted price adjustment"
+		if billing.CancellationFee != nil {
+			description = "Cancellation adjustment"
+		}
+		items = append(items, InvoiceLineItem{
+			Kind:        lineAdjustment,
+			Description: description,
+			Quantity:    1,
+			UnitPrice:   adjustment,
+			Amount:      adjustment,
+		})
+	}
+
+	if !billing.TaxAmount.IsZero() {
+		// The current rate is only used for the label; the amount is what was billed
+		taxRate, err := taxRateFor(d.Location)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, InvoiceLineItem{
+			Kind:        lineTax,
+			Description: taxRate.description(),
+			Quantity:    1,
+			UnitPrice:   billing.TaxAmount,
+			Amount:      billing.TaxAmount,
+		})
+	}
+	return items, nil
+}
+
+// billingIsFinal reports whether a billing's amount can no longer change: it
+// has been paid, or fixed by a cancellation. Promotions, reschedules and late
+// returns only reprice Pending billings without a cancellation fee.
+func billingIsFinal(billing Billing) bool {
+	return billing.PaymentStatus != billingPending || billing.CancellationFee != nil
+}
+
+// issueInvoice stores the invoice of a billing under the next invoice number.
+// If another request issued it first, that invoice is returned instead. Only
+// final billings are invoiced, so an invoice always matches what was charged;
+// others return errBillingNotFinal.
+func issueInvoice(billingID int) (Invoice, error) {
+	billing, err := scanBilling(billingDB.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ?", billingID))
+	if err != nil {
+		return Invoice{}, err
+	}
+	if !billingIsFinal(billing) {
+		return Invoice{}, errBillingNotFinal
+	}
+
+	d, err := loadReservation(billing.ReservationID)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to fetch reservation: %v", err)
+	}
+
+	inv := Invoice{
+		BillingID:     billing.ID,
+		ReservationID: billing.ReservationID,
+		VehicleType:   d.VehicleType,
+		RentalStart:   d.StartTime.Format(mysqlDateTimeLayout),
+		RentalEnd:     d.EndTime.Format(mysqlDateTimeLayout),
+		Currency:      billing.Amount.Currency,
+		Subtotal:      billing.Amount.Sub(billing.TaxAmount),
+		Tax:           billing.TaxAmount,
+		Amount:        billing.Amount,
+	}
+	err = userDB.QueryRow("SELECT name, email FROM users WHERE id = ?", billing.UserID).Scan(&inv.CustomerName, &inv.CustomerEmail)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to fetch customer: %v", err)
+	}
+	err = vehicleDB.QueryRow("SELECT COALESCE(make, ''), COALESCE(model, '') FROM vehicles WHERE id = ?", d.VehicleID).Scan(&inv.VehicleMake, &inv.VehicleModel)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to fetch vehicle: %v", err)
+	}
+
+	if inv.LineItems, err = invoiceLineItems(d, billing); err != nil {
+		return Invoice{}, err
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	// The sequence row stays locked until commit, so numbers have no gaps
+	res, err := tx.Exec("UPDATE invoice_sequence SET last_number = LAST_INSERT_ID(last_number + 1)")
+	if err != nil {
+		return Invoice{}, err
+	}
+	number, err := res.LastInsertId()
+	if err != nil {
+		return Invoice{}, err
+	}
+	inv.InvoiceNumber = fmt.Sprintf("INV-%06d", number)
+
+	res, err = tx.Exec(`
+		INSERT INTO invoices (invoice_number, billing_id, reservation_id, customer_name, customer_email, vehicle_make, vehicle_model,
+			vehicle_type, rental_start, rental_end, currency, subtotal, tax, total)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		inv.InvoiceNumber, inv.BillingID, inv.ReservationID, inv.CustomerName, inv.CustomerEmail, inv.VehicleMake, inv.VehicleModel,
+		inv.VehicleType, inv.RentalStart, inv.RentalEnd, inv.Currency, inv.Subtotal, inv.Tax, inv.Amount)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			tx.Rollback()
+			return loadInvoice(billingID)
+		}
+		return Invoice{}, err
+	}
+	invoiceID, _ := res.LastInsertId()
+
+	for _, item := range inv.LineItems {
+		_, err := tx.Exec("INSERT INTO invoice_line_items (invoice_id, kind, description, quantity, unit_price, amount) VALUES (?, ?, ?, ?, ?, ?)",
+			invoiceID, item.Kind, item.Description, item.Quantity, item.UnitPrice, item.Amount)
+		if err != nil {
+			return Invoice{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Invoice{}, err
+	}
+	return loadInvoice(billingID)
+}
+
+// invoiceForBilling returns the invoice of a billing, issuing it if needed
+func invoiceForBilling(billingID int) (Invoice, error) {
+	invoice, err := loadInvoice(billingID)
+	if err == sql.ErrNoRows {
+		return issueInvoice(billingID)
+	}
+	return invoice, err
+}
+
+// Get the invoice of a billing as JSON or PDF, issuing it on the first request
+// once the billing is final. Later requests return the same invoice.
+func generateInvoice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	billingID, err := strconv.Atoi(params["billing_id"])
+	if err != nil {
+		http.Error(w, "Invalid billing ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeBillingAccess(w, r, params["billing_id"]) {
+		return
+	}
+
+	invoice, err := invoiceForBilling(billingID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Billing not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errBillingNotFinal) {
+		http.Error(w, "Billing is not final yet; it is invoiced once paid or cancelled", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to generate invoice for billing %d: %v", billingID, err)
+		http.Error(w, "Failed to generate invoice", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsPDF(r) {
+		writePDF(w, invoice.InvoiceNumber+".pdf", renderInvoicePDF(invoice))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoice)
+}
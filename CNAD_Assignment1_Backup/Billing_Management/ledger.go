@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of ledger entry, stored in ledger_entries.kind
+const (
+	ledgerCharge     = "charge"
+	ledgerPayment    = "payment"
+	ledgerRefund     = "refund"
+	ledgerPromotion  = "promotion"
+	ledgerFee        = "fee"
+	ledgerAdjustment = "adjustment"
+	ledgerTopUp      = "top_up"
+	ledgerCredit     = "credit"
+	ledgerDeposit    = "deposit"
+)
+
+// Company accounts. Each customer also has an account, named by
+// customerAccount, holding what they owe, and a wallet account named by
+// walletAccount.
+const (
+	accountCash             = "cash"              // money held by the payment gateway
+	accountRevenue          = "revenue"           // rental income, before tax
+	accountTaxPayable       = "tax_payable"       // tax collected for the authorities
+	accountPromotions       = "promotions"        // discounts given by promotion codes
+	accountRefunds          = "refunds"           // money returned to customers
+	accountCancellationFees = "cancellation_fees" // income from late cancellations, before tax
+	accountGoodwill         = "goodwill"          // wallet credits given by support
+	accountDepositCaptures  = "deposit_captures"  // deposits kept for damages and fees
+	accountLateReturns      = "late_returns"      // overtime charged for late returns, before tax
+)
+
+var errUnbalancedEntry = errors.New("ledger entry does not balance")
+
+func customerAccount(userID int) string {
+	return fmt.Sprintf("customer:%d", userID)
+}
+
+// LedgerLine moves Amount into (debit, positive) or out of (credit, negative) an account
+type LedgerLine struct {
+	Account string `json:"account"`
+	Amount  Money  `json:"amount"`
+}
+
+// LedgerEntry is one balanced journal entry. Entries are never changed once
+// posted; mistakes are corrected by posting another entry.
+type LedgerEntry struct {
+	ID          int          `json:"id"`
+	UserID      int          `json:"user_id"`
+	BillingID   *int         `json:"billing_id,omitempty"`
+	Kind        string       `json:"kind"`
+	Description string       `json:"description"`
+	Lines       []LedgerLine `json:"lines"`
+	CreatedAt   string       `json:"created_at"`
+}
+
+// postLedgerEntry records an entry inside tx. Lines with a zero amount are
+// skipped, and the rest must sum to zero in each currency.
+func postLedgerEntry(tx *sql.Tx, userID, billingID int, kind, description string, lines ...LedgerLine) error {
+	sums := map[string]int64{}
+	var posted []LedgerLine
+	for _, line := range lines {
+		if line.Amount.IsZero() {
+			continue
+		}
+		sums[line.Amount.Currency] += line.Amount.Minor
+		posted = append(posted, line)
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: %s %s: off by %d", errUnbalancedEntry, kind, currency, sum)
+		}
+	}
+	if len(posted) == 0 {
+		return nil
+	}
+
+	res, err := tx.Exec("INSERT INTO ledger_entries (user_id, billing_id, kind, description) VALUES (?, NULLIF(?, 0), ?, ?)",
+		userID, billingID, kind, description)
+	if err != nil {
+		return err
+	}
+	entryID, _ := res.LastInsertId()
+	for _, line := range posted {
+		_, err := tx.Exec("INSERT INTO ledger_lines (entry_id, account, currency, amount) VALUES (?, ?, ?, ?)",
+			entryID, line.Account, line.Amount.Currency, line.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postCharge records a new billing at its price before promotions, so the
+// promotion shows as its own credit to the customer
+func postCharge(tx *sql.Tx, billing Billing, promoDiscount Money) error {
+	customer := customerAccount(billing.UserID)
+	gross := billing.Amount.Add(promoDiscount)
+	err := postLedgerEntry(tx, billing.UserID, billing.ID, ledgerCharge, fmt.Sprintf("Rental charge for reservation %d", billing.ReservationID),
+		LedgerLine{customer, gross},
+		LedgerLine{accountRevenue, billing.Amount.Sub(billing.TaxAmount).Add(promoDiscount).Neg()},
+		LedgerLine{accountTaxPayable, billing.TaxAmount.Neg()})
+	if err != nil {
+		return err
+	}
+	return postLedgerEntry(tx, billing.UserID, billing.ID, ledgerPromotion, "Promotion credit",
+		LedgerLine{accountPromotions, promoDiscount},
+		LedgerLine{customer, promoDiscount.Neg()})
+}
+
+// postFee records a billing that only charges a cancellation fee
+func postFee(tx *sql.Tx, billing Billing, description string) error {
+	return postLedgerEntry(tx, billing.UserID, billing.ID, ledgerFee, description,
+		LedgerLine{customerAccount(billing.UserID), billing.Amount},
+		LedgerLine{accountCancellationFees, billing.Amount.Sub(billing.TaxAmount).Neg()},
+		LedgerLine{accountTaxPayable, billing.TaxAmount.Neg()})
+}
+
+// postReprice records a change to the amount of an unpaid billing. The change
+// before tax is taken from account, and the tax moves with it.
+func postReprice(tx *sql.Tx, kind, description, account string, before, after Billing) error {
+	preTaxChange := before.Amount.Sub(before.TaxAmount).Sub(after.Amount.Sub(after.TaxAmount))
+	return postLedgerEntry(tx, after.UserID, after.ID, kind, description,
+		LedgerLine{account, preTaxChange},
+		LedgerLine{accountTaxPayable, before.TaxAmount.Sub(after.TaxAmount)},
+		LedgerLine{customerAccount(after.UserID), before.Amount.Sub(after.Amount).Neg()})
+}
+
+// postPayment records money received from the customer for a billing, into
+// cash for card payments or out of their wallet account
+func postPayment(tx *sql.Tx, billing Billing, account, reference string) error {
+	description := "Card payment " + reference
+	if account != accountCash {
+		description = "Wallet payment " + reference
+	}
+	return postLedgerEntry(tx, billing.UserID, billing.ID, ledgerPayment, description,
+		LedgerLine{account, billing.Amount},
+		LedgerLine{customerAccount(billing.UserID), billing.Amount.Neg()})
+}
+
+// postRefund records money returned to the customer. Refunds are paid out of
+// account (cash, or the wallet a payment came from) and do not change what the
+// billing charged.
+func postRefund(tx *sql.Tx, userID, billingID int, amount Money, account, reasonCode string) error {
+	return postLedgerEntry(tx, userID, billingID, ledgerRefund, "Refund: "+reasonCode,
+		LedgerLine{accountRefunds, amount},
+		LedgerLine{account, amount.Neg()})
+}
+
+// loadLedgerEntries returns entries with their lines, oldest first
+func loadLedgerEntries(query string, args ...interface{}) ([]LedgerEntry, error) {
+	rows, err := billingDB.Query(`
+		SELECT e.id, e.user_id, COALESCE(e.billing_id, 0), e.kind, e.description, e.created_at, l.account, l.currency, l.amount
+		FROM ledger_entries e
+		JOIN ledger_lines l ON l.entry_id = e.id
+		WHERE `+query+`
+		ORDER BY e.id, l.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		var billingID int
+		var line LedgerLine
+		var currency string
+		var amount moneyColumn
+		if err := rows.Scan(&e.ID, &e.UserID, &billingID, &e.Kind, &e.Description, &e.CreatedAt, &line.Account, &currency, &amount); err != nil {
+			return nil, err
+		}
+		if line.Amount, err = amount.money(currency); err != nil {
+			return nil, err
+		}
+		if n := len(entries); n > 0 && entries[n-1].ID == e.ID {
+			entries[n-1].Lines = append(entries[n-1].Lines, line)
+			continue
+		}
+		if billingID != 0 {
+			e.BillingID = &billingID
+		}
+		e.Lines = []LedgerLine{line}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Show the balance of a user's account in each currency. A positive balance
+// is owed by the user; a negative one is owed to them.
+func getUserBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeUserAccess(w, r, userID) {
+		return
+	}
+
+	account := customerAccount(userID)
+	sums, err := sumByCurrency("SELECT currency, SUM(amount) FROM ledger_lines WHERE account = ? GROUP BY currency", account)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+	balances := []Money{}
+	for _, balance := range sums {
+		balances = append(balances, balance)
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Currency < balances[j].Currency })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":  userID,
+		"account":  account,
+		"balances": balances,
+	})
+}
+
+// List the ledger entries of a billing
+func getBillingLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	entries, err := loadLedgerEntries("e.billing_id = ?", billingID)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger entries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// ReconciliationIssue is a billing whose ledger disagrees with the billing,
+// payment or refund records, a wallet whose balance disagrees with the ledger,
+// or an entry that does not balance
+type ReconciliationIssue struct {
+	BillingID int    `json:"billing_id,omitempty"`
+	UserID    int    `json:"user_id,omitempty"`
+	EntryID   int    `json:"entry_id,omitempty"`
+	Problem   string `json:"problem"`
+	Expected  Money  `json:"expected"`
+	Ledger    Money  `json:"ledger"`
+}
+
+// Check the ledger against every billing: what it charged the customer must
+// sum to the billing amount, and its payments and refunds must match the
+// payments and refunds recorded for the billing. Also checks every wallet
+// balance and lists entries that do not balance.
+func getReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	ledgerSum := func(kinds, account string) string {
+		return `(SELECT SUM(l.amount) FROM ledger_lines l JOIN ledger_entries e ON e.id = l.entry_id
+			WHERE e.billing_id = b.id AND e.kind ` + kinds + ` AND l.account = ` + account + `)`
+	}
+	customer := "CONCAT('customer:', b.user_id)"
+	rows, err := billingDB.Query(`
+		SELECT b.id, b.currency,
+			b.amount, ` + ledgerSum("NOT IN ('payment', 'refund')", customer) + `,
+			(SELECT SUM(amount) FROM payments p WHERE p.billing_id = b.id AND p.status = 'succeeded'), -` + ledgerSum("= 'payment'", customer) + `,
+			(SELECT SUM(amount) FROM refunds rf WHERE rf.billing_id = b.id), ` + ledgerSum("= 'refund'", "'refunds'") + `
+		FROM billings b
+		ORDER BY b.id`)
+	if err != nil {
+		http.Error(w, "Failed to reconcile billings", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	issues := []ReconciliationIssue{}
+	for rows.Next() {
+		var billingID int
+		var currency string
+		// Pairs of expected and ledger amounts: charges, payments and refunds
+		var columns [6]moneyColumn
+		if err := rows.Scan(&billingID, &currency, &columns[0], &columns[1], &columns[2], &columns[3], &columns[4], &columns[5]); err != nil {
+			http.Error(w, "Failed to parse reconciliation data", http.StatusInternalServerError)
+			return
+		}
+		for i, problem := range []string{"charges do not sum to the billing amount", "payments do not match the ledger", "refunds do not match the ledger"} {
+			expected, err := columns[2*i].money(currency)
+			if err != nil {
+				http.Error(w, "Failed to parse reconciliation data", http.StatusInternalServerError)
+				return
+			}
+			ledger, err := columns[2*i+1].money(currency)
+			if err != nil {
+				http.Error(w, "Failed to parse reconciliation data", http.StatusInternalServerError)
+				return
+			}
+			if expected != ledger {
+				issues = append(issues, ReconciliationIssue{BillingID: billingID, Problem: problem, Expected: expected, Ledger: ledger})
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to reconcile billings", http.StatusInternalServerError)
+		return
+	}
+
+	wallets, err := billingDB.Query(`
+		SELECT w.user_id, w.currency, w.balance,
+			-(SELECT SUM(l.amount) FROM ledger_lines l WHERE l.account = CONCAT('wallet:', w.user_id) AND l.currency = w.currency)
+		FROM wallets w
+		ORDER BY w.user_id, w.currency`)
+	if err != nil {
+		http.Error(w, "Failed to reconcile wallets", http.StatusInternalServerError)
+		return
+	}
+	defer wallets.Close()
+	for wallets.Next() {
+		var userID int
+		var currency string
+		var balance, sum moneyColumn
+		if err := wallets.Scan(&userID, &currency, &balance, &sum); err != nil {
+			http.Error(w, "Failed to parse wallet data", http.StatusInternalServerError)
+			return
+		}
+		expected, err := balance.money(currency)
+		if err != nil {
+			http.Error(w, "Failed to parse wallet data", http.StatusInternalServerError)
+			return
+		}
+		ledger, err := sum.money(currency)
+		if err != nil {
+			http.Error(w, "Failed to parse wallet data", http.StatusInternalServerError)
+			return
+		}
+		if expected != ledger {
+			issues = append(issues, ReconciliationIssue{UserID: userID, Problem: "wallet balance does not match the ledger", Expected: expected, Ledger: ledger})
+		}
+	}
+	if err := wallets.Err(); err != nil {
+		http.Error(w, "Failed to reconcile wallets", http.StatusInternalServerError)
+		return
+	}
+
+	unbalanced, err := billingDB.Query("SELECT entry_id, currency, SUM(amount) FROM ledger_lines GROUP BY entry_id, currency HAVING SUM(amount) <> 0 ORDER BY entry_id")
+	if err != nil {
+		http.Error(w, "Failed to check ledger entries", http.StatusInternalServerError)
+		return
+	}
+	defer unbalanced.Close()
+	for unbalanced.Next() {
+		var entryID int
+		var currency string
+		var sum moneyColumn
+		if err := unbalanced.Scan(&entryID, &currency, &sum); err != nil {
+			http.Error(w, "Failed to parse ledger entries", http.StatusInternalServerError)
+			return
+		}
+		ledger, err := sum.money(currency)
+		if err != nil {
+			http.Error(w, "Failed to parse ledger entries", http.StatusInternalServerError)
+			return
+		}
+		issues = append(issues, ReconciliationIssue{EntryID: entryID, Problem: "entry does not balance", Expected: zeroMoney(currency), Ledger: ledger})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reconciled": len(issues) == 0,
+		"issues":     issues,
+	})
+}
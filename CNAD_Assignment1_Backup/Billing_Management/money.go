@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Money amounts are integers in the minor unit of their currency, so sums and
+// differences are exact. Rounding only happens when an amount is scaled:
+//
+//   - percentages (membership discounts, promotions, cancellation fees and
+//     exclusive tax) are rounded half away from zero to the minor unit, once,
+//     on the amount they apply to
+//   - hourly rates are prorated to the second and rounded the same way
+//   - inclusive tax is the total minus the total divided by (1 + rate),
+//     the latter rounded half away from zero
+//
+// Percentages are used to two decimal places, matching the DECIMAL(5,2) columns.
+
+// Currency of billings and prices unless configured otherwise
+var defaultCurrency = getEnv("BILLING_CURRENCY", "SGD")
+
+// currencyExponents lists the currencies whose minor unit is not a hundredth
+var currencyExponents = map[string]int{"JPY": 0, "KRW": 0}
+
+var errCurrencyMismatch = errors.New("amounts are in different currencies")
+
+// Money is an amount in minor units of an ISO 4217 currency
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// isCurrencyCode reports whether s looks like an ISO 4217 code, e.g. "SGD"
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+func minorUnitsPerMajor(currency string) int64 {
+	return int64(math.Pow10(currencyExponent(currency)))
+}
+
+// divRound divides rounding half away from zero
+func divRound(numerator, denominator int64) int64 {
+	if (numerator < 0) != (denominator < 0) {
+		return -((abs64(numerator) + abs64(denominator)/2) / abs64(denominator))
+	}
+	return (abs64(numerator) + abs64(denominator)/2) / abs64(denominator)
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// basisPoints converts a percentage to hundredths of a percent
+func basisPoints(percentage float64) int64 {
+	return int64(math.Round(percentage * 100))
+}
+
+func zeroMoney(currency string) Money {
+	return Money{Currency: currency}
+}
+
+// parseMoney reads a decimal amount such as "12.34" or "-5" exactly. Digits
+// beyond the currency's minor unit are rounded half away from zero.
+func parseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" && fraction == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	exponent := currencyExponent(currency)
+	roundUp := false
+	if len(fraction) > exponent {
+		roundUp = fraction[exponent] >= '5'
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || strings.ContainsAny(whole+fraction, "+-") {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if roundUp {
+		minor++
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// String formats the amount in major units without the currency, e.g. "12.34"
+func (m Money) String() string {
+	exponent := currencyExponent(m.Currency)
+	sign := ""
+	minor := m.Minor
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	if exponent == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	unit := minorUnitsPerMajor(m.Currency)
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/unit, exponent, minor%unit)
+}
+
+// Format is the amount for people, e.g. "SGD 12.34"
+func (m Money) Format() string {
+	if m.Minor < 0 {
+		return "-" + m.Currency + " " + m.Neg().String()
+	}
+	return m.Currency + " " + m.String()
+}
+
+func (m Money) mustMatch(o Money) {
+	if m.Currency != o.Currency {
+		panic(fmt.Sprintf("%v: %s and %s", errCurrencyMismatch, m.Currency, o.Currency))
+	}
+}
+
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor + o.Minor, Currency: m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor - o.Minor, Currency: m.Currency}
+}
+
+func (m Money) Neg() Money {
+	return Money{Minor: -m.Minor, Currency: m.Currency}
+}
+
+func (m Money) IsZero() bool     { return m.Minor == 0 }
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+
+func (m Money) LessThan(o Money) bool {
+	m.mustMatch(o)
+	return m.Minor < o.Minor
+}
+
+func (m Money) Min(o Money) Money {
+	if o.LessThan(m) {
+		return o
+	}
+	return m
+}
+
+// Percent is percentage percent of the amount
+func (m Money) Percent(percentage float64) Money {
+	return Money{Minor: divRound(m.Minor*basisPoints(percentage), 10000), Currency: m.Currency}
+}
+
+// Prorate is an hourly rate charged for duration d
+func (m Money) Prorate(d time.Duration) Money {
+	return Money{Minor: divRound(m.Minor*int64(d/time.Second), 3600), Currency: m.Currency}
+}
+
+// excludingPercent removes an included percentage, e.g. inclusive tax: the
+// result is the amount before percentage was added to it
+func (m Money) excludingPercent(percentage float64) Money {
+	return Money{Minor: divRound(m.Minor*10000, 10000+basisPoints(percentage)), Currency: m.Currency}
+}
+
+// Value stores the amount in a DECIMAL column
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// moneyColumn scans a DECIMAL column as text, so the amount can be read
+// exactly once the currency of the row is known
+type moneyColumn struct {
+	sql.NullString
+}
+
+func (c moneyColumn) money(currency string) (Money, error) {
+	if !c.Valid {
+		return zeroMoney(currency), nil
+	}
+	return parseMoney(c.String, currency)
+}
+
+// MarshalJSON writes {"amount": "12.34", "currency": "SGD"}. Amounts are
+// strings so clients never round-trip them through floating point.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.Currency})
+}
+
+// UnmarshalJSON accepts the object written by MarshalJSON, or a bare amount as
+// a string or number. A bare amount leaves Currency empty for the caller to set.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var object struct {
+		Amount   json.RawMessage `json:"amount"`
+		Currency string          `json:"currency"`
+	}
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		data = object.Amount
+	}
+
+	amount := strings.Trim(string(data), `"`)
+	parsed, err := parseMoney(amount, object.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// inCurrency gives a bare amount decoded from JSON the expected currency, and
+// reports false if it was sent in another one. The amount is reparsed since
+// the minor unit depends on the currency.
+func (m Money) inCurrency(currency string) (Money, bool) {
+	if m.Currency == currency {
+		return m, true
+	}
+	if m.Currency != "" {
+		return m, false
+	}
+	parsed, err := parseMoney(Money{Minor: m.Minor, Currency: ""}.String(), currency)
+	return parsed, err == nil
+}
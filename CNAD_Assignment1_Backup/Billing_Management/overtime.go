@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	errNotReturned  = errors.New("reservation has not been returned")
+	errBillingFinal = errors.New("billing has already been paid")
+)
+
+// LateReturnPolicy prices late returns for a membership tier. Returns up to
+// GraceMinutes after the booked end time are free; later ones are charged for
+// all of the overtime at RatePercentage of the vehicle's hourly base rate.
+type LateReturnPolicy struct {
+	GraceMinutes   int     `json:"grace_minutes"`
+	RatePercentage float64 `json:"rate_percentage"`
+}
+
+// Overtime is the late return charge of a reservation
+type Overtime struct {
+	ReservationID int              `json:"reservation_id"`
+	BillingID     int              `json:"billing_id,omitempty"` // 0 until the reservation is billed
+	ReturnedAt    string           `json:"returned_at"`
+	Minutes       int              `json:"minutes_late"`
+	Policy        LateReturnPolicy `json:"policy"`
+	Charge        Money            `json:"charge"` // before tax
+}
+
+// lateReturnPolicy loads the policy of a membership tier from
+// late_return_policies, falling back to the default policy (membership_tier
+// NULL). Without either, late returns are free.
+func lateReturnPolicy(membershipTier string) (LateReturnPolicy, error) {
+	var policy LateReturnPolicy
+	err := billingDB.QueryRow("SELECT grace_minutes, rate_percentage FROM late_return_policies WHERE membership_tier = ?", membershipTier).
+		Scan(&policy.GraceMinutes, &policy.RatePercentage)
+	if err == sql.ErrNoRows {
+		err = billingDB.QueryRow("SELECT grace_minutes, rate_percentage FROM late_return_policies WHERE membership_tier IS NULL").
+			Scan(&policy.GraceMinutes, &policy.RatePercentage)
+	}
+	if err == sql.ErrNoRows {
+		return LateReturnPolicy{}, nil
+	}
+	return policy, err
+}
+
+// overtimeCharge prices the time between a returned reservation's end and its
+// return, in the currency the reservation is priced in
+func overtimeCharge(d reservationDetails) (Overtime, error) {
+	overtime := Overtime{ReservationID: d.ID, ReturnedAt: d.ReturnedAt.Format(mysqlDateTimeLayout), Charge: zeroMoney(d.Currency)}
+	late := d.ReturnedAt.Sub(d.EndTime)
+	if late <= 0 {
+		return overtime, nil
+	}
+	overtime.Minutes = int(late / time.Minute)
+
+	policy, err := lateReturnPolicy(d.MembershipTier)
+	if err != nil {
+		return overtime, err
+	}
+	overtime.Policy = policy
+	if late <= time.Duration(policy.GraceMinutes)*time.Minute {
+		return overtime, nil
+	}
+
+	baseRate, err := getVehiclePricing(d.VehicleType, d.Currency)
+	if err != nil {
+		return overtime, err
+	}
+	overtime.Charge = baseRate.Percent(policy.RatePercentage).Prorate(late)
+	return overtime, nil
+}
+
+func overtimeDescription(minutes int) string {
+	return fmt.Sprintf("Late return, %d minutes after the booked end time", minutes)
+}
+
+// addOvertime adds the overtime charge of a returned reservation to its
+// Pending billing inside tx, which must hold the billing row lock. Each billing
+// is assessed once; billings already assessed, no longer Pending, or whose
+// reservation has not been returned are returned unchanged.
+func addOvertime(tx *sql.Tx, billing Billing) (Billing, error) {
+	if billing.OvertimeFee != nil || billing.PaymentStatus != billingPending {
+		return billing, nil
+	}
+	d, err := loadReservation(billing.ReservationID)
+	if err != nil {
+		return billing, err
+	}
+	if d.ReturnedAt.IsZero() {
+		return billing, nil
+	}
+	d.Currency = billing.Amount.Currency
+	overtime, err := overtimeCharge(d)
+	if err != nil {
+		return billing, err
+	}
+
+	after := billing
+	after.OvertimeMinutes = overtime.Minutes
+	after.OvertimeFee = &overtime.Charge
+	if overtime.Charge.IsPositive() {
+		taxRate, err := taxRateFor(d.Location)
+		if err != nil {
+			return billing, err
+		}
+		setBillingPrice(&after, billing.preTaxAmount().Add(overtime.Charge), taxRate)
+	}
+	_, err = tx.Exec("UPDATE billings SET amount = ?, tax_amount = ?, overtime_minutes = ?, overtime_fee = ? WHERE id = ?",
+		after.Amount, after.TaxAmount, after.OvertimeMinutes, overtime.Charge, billing.ID)
+	if err != nil {
+		return billing, err
+	}
+	if err := postReprice(tx, ledgerFee, overtimeDescription(overtime.Minutes), accountLateReturns, billing, after); err != nil {
+		return billing, err
+	}
+	return after, nil
+}
+
+// assessOvertime runs addOvertime on a billing in its own transaction
+func assessOvertime(billingID int) (Billing, error) {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return Billing{}, err
+	}
+	defer tx.Rollback()
+
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ? FOR UPDATE", billingID))
+	if err != nil {
+		return billing, err
+	}
+	if billing, err = addOvertime(tx, billing); err != nil {
+		return billing, err
+	}
+	return billing, tx.Commit()
+}
+
+// Charge for a late return. Vehicle_Management calls this when a reservation is
+// completed. The charge is added to the reservation's billing while it is still
+// Pending, which also means it has not been invoiced; reservations billed later
+// get it when they are billed. Calling it again returns the same charge.
+func lateReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ReservationID int `json:"reservation_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	d, err := loadReservation(input.ReservationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeReservationAccess(w, r, d.UserID) {
+		return
+	}
+
+	overtime, err := lateReturn(d)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotReturned):
+		http.Error(w, "Reservation has not been returned", http.StatusConflict)
+		return
+	case errors.Is(err, errBillingFinal):
+		http.Error(w, "Billing has already been paid", http.StatusConflict)
+		return
+	default:
+		log.Printf("Failed to charge late return of reservation %d: %v", d.ID, err)
+		http.Error(w, "Failed to charge late return", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overtime)
+}
+
+// lateReturn works out the overtime of a returned reservation and adds it to
+// its billing, if there is one
+func lateReturn(d reservationDetails) (Overtime, error) {
+	if d.Status != "completed" || d.ReturnedAt.IsZero() {
+		return Overtime{}, errNotReturned
+	}
+
+	billing, err := scanBilling(billingDB.QueryRow("SELECT "+billingColumns+" FROM billings WHERE reservation_id = ?", d.ID))
+	if err == sql.ErrNoRows {
+		// Priced again when the reservation is billed
+		return overtimeCharge(d)
+	} else if err != nil {
+		return Overtime{}, err
+	}
+
+	if billing.OvertimeFee == nil {
+		if billing.PaymentStatus != billingPending {
+			return Overtime{}, errBillingFinal
+		}
+		if billing, err = assessOvertime(billing.ID); err != nil {
+			return Overtime{}, err
+		}
+	}
+
+	d.Currency = billing.Amount.Currency
+	overtime, err := overtimeCharge(d)
+	if err != nil {
+		return overtime, err
+	}
+	// Report what was billed, even if the policy changed since
+	overtime.BillingID = billing.ID
+	overtime.Minutes = billing.OvertimeMinutes
+	if billing.OvertimeFee != nil {
+		overtime.Charge = *billing.OvertimeFee
+	}
+	return overtime, nil
+}
+
+// Show the late return policy that applies to a membership tier
+func getLateReturnPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy, err := lateReturnPolicy(r.URL.Query().Get("tier"))
+	if err != nil {
+		http.Error(w, "Failed to fetch late return policy", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment is one recorded attempt to pay a billing
+type Payment struct {
+	ID            int    `json:"id"`
+	BillingID     int    `json:"billing_id"`
+	Method        string `json:"method"`
+	Amount        Money  `json:"amount"`
+	Status        string `json:"status"`
+	Reference     string `json:"gateway_reference"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	CardLast4     string `json:"card_last4"`
+	CardToken     string `json:"-"` // gateway token of the card, for dunning retries
+	RedirectURL   string `json:"redirect_url,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	CompletedAt   string `json:"completed_at,omitempty"`
+}
+
+const paymentColumns = "id, billing_id, method, currency, amount, status, gateway_reference, COALESCE(failure_reason, ''), card_last4, COALESCE(card_token, ''), created_at, COALESCE(completed_at, '')"
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (Payment, error) {
+	var p Payment
+	var currency string
+	var amount moneyColumn
+	err := row.Scan(&p.ID, &p.BillingID, &p.Method, &currency, &amount, &p.Status, &p.Reference, &p.FailureReason, &p.CardLast4, &p.CardToken, &p.CreatedAt, &p.CompletedAt)
+	if err != nil {
+		return p, err
+	}
+	p.Amount, err = amount.money(currency)
+	return p, err
+}
+
+// paymentResponseStatus maps a payment outcome to the HTTP status returned to the client
+func paymentResponseStatus(status string) int {
+	switch status {
+	case paymentSucceeded:
+		return http.StatusCreated
+	case paymentRequiresAction:
+		return http.StatusAccepted
+	}
+	return http.StatusPaymentRequired
+}
+
+// lockUnpaidBilling locks the billing row for the transaction and returns it.
+// It writes the error response and returns false if it cannot be paid.
+func lockUnpaidBilling(w http.ResponseWriter, tx *sql.Tx, billingID string) (Billing, bool) {
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ? FOR UPDATE", billingID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Billing not found", http.StatusNotFound)
+		return Billing{}, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch billing data", http.StatusInternalServerError)
+		return Billing{}, false
+	}
+	if billing.PaymentStatus == billingVoid {
+		http.Error(w, "Billing has been voided", http.StatusConflict)
+		return Billing{}, false
+	}
+	if billing.PaymentStatus != billingPending {
+		http.Error(w, "Billing has already been paid", http.StatusConflict)
+		return Billing{}, false
+	}
+	return billing, true
+}
+
+// markBillingPaid flips the billing to Paid when a payment succeeds, records
+// the payment in the ledger as money received into account and ends any
+// dunning of the billing
+func markBillingPaid(tx *sql.Tx, billing Billing, account, reference string) error {
+	if _, err := tx.Exec("UPDATE billings SET payment_status = ? WHERE id = ?", billingPaid, billing.ID); err != nil {
+		return err
+	}
+	if err := settleDunning(tx, billing.ID); err != nil {
+		return err
+	}
+	return postPayment(tx, billing, account, reference)
+}
+
+// Pay a billing by card through the configured PaymentGateway, or from the
+// customer's wallet with "method": "wallet". Every card attempt is recorded,
+// including declines and pending 3-D Secure challenges.
+func createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	var input struct {
+		Method      string `json:"method"`
+		CardNumber  string `json:"card_number"`
+		ExpiryMonth int    `json:"expiry_month"`
+		ExpiryYear  int    `json:"expiry_year"`
+		CVC         string `json:"cvc"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if input.Method == "" {
+		input.Method = methodCard
+	}
+	if (input.Method != methodCard && input.Method != methodWallet) || (input.Method == methodCard && len(input.CardNumber) < 4) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	// The billing row stays locked while the gateway is called so that two
+	// concurrent attempts cannot both charge the customer
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	billing, ok := lockUnpaidBilling(w, tx, billingID)
+	if !ok {
+		return
+	}
+	// A late return is charged before the billing is settled
+	billing, err = addOvertime(tx, billing)
+	if err != nil {
+		log.Printf("Failed to charge late return for billing %s: %v", billingID, err)
+		http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+		return
+	}
+	amount := billing.Amount
+
+	if input.Method == methodWallet {
+		paymentID, err := payFromWallet(tx, billing)
+		if err == errInsufficientFunds {
+			http.Error(w, "Insufficient wallet balance", http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("Failed to pay billing %d from wallet: %v", billing.ID, err)
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+		payment, err := scanPayment(billingDB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", paymentID))
+		if err != nil {
+			http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(payment)
+		return
+	}
+
+	id, _ := strconv.Atoi(billingID)
+	result, err := paymentGateway.Charge(ChargeRequest{
+		BillingID:   id,
+		Amount:      amount,
+		CardNumber:  input.CardNumber,
+		ExpiryMonth: input.ExpiryMonth,
+		ExpiryYear:  input.ExpiryYear,
+		CVC:         input.CVC,
+	})
+	if err != nil {
+		log.Printf("Payment gateway error for billing %d: %v", id, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Pending 3-D Secure challenges are completed by confirmPaymentHandler
+	completed := result.Status != paymentRequiresAction
+	res, err := tx.Exec(`
+		INSERT INTO payments (billing_id, currency, amount, status, gateway_reference, failure_reason, card_last4, card_token, completed_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), IF(?, NOW(), NULL))`,
+		id, amount.Currency, amount, result.Status, result.Reference, result.FailureReason, input.CardNumber[len(input.CardNumber)-4:], result.CardToken, completed)
+	if err != nil {
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+	paymentID, _ := res.LastInsertId()
+
+	switch result.Status {
+	case paymentSucceeded:
+		if err := markBillingPaid(tx, billing, accountCash, result.Reference); err != nil {
+			http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+			return
+		}
+	case paymentDeclined:
+		// The card is retried on the dunning schedule until the billing is paid
+		if err := openDunning(tx, billing, int(paymentID)); err != nil {
+			log.Printf("Failed to start dunning for billing %d: %v", billing.ID, err)
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+
+	payment, err := scanPayment(billingDB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", paymentID))
+	if err != nil {
+		http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+		return
+	}
+	payment.RedirectURL = result.RedirectURL
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(payment.Status))
+	json.NewEncoder(w).Encode(payment)
+}
+
+// Complete a payment that is waiting on a 3-D Secure challenge
+func confirmPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	billingID := vars["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	var input struct {
+		ChallengeCode string `json:"challenge_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	billing, ok := lockUnpaidBilling(w, tx, billingID)
+	if !ok {
+		return
+	}
+
+	payment, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ? AND billing_id = ?", vars["payment_id"], billingID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+		return
+	}
+	if payment.Status != paymentRequiresAction {
+		http.Error(w, "Payment is not awaiting confirmation", http.StatusConflict)
+		return
+	}
+
+	// A late return is charged before the billing is settled
+	billing, err = addOvertime(tx, billing)
+	if err != nil {
+		log.Printf("Failed to charge late return for billing %s: %v", billingID, err)
+		http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+		return
+	}
+	// The card was authorized for what the billing came to when the payment
+	// was started. If it has been repriced since, the authorization is given
+	// up and the customer has to pay the new amount.
+	if payment.Amount != billing.Amount {
+		if err := paymentGateway.Void(payment.Reference); err != nil {
+			log.Printf("Payment gateway error voiding payment %d: %v", payment.ID, err)
+			http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+			return
+		}
+		_, err = tx.Exec("UPDATE payments SET status = ?, failure_reason = 'amount_changed', completed_at = NOW() WHERE id = ?", paymentDeclined, payment.ID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Billing amount has changed since the payment was started; pay the new amount", http.StatusConflict)
+		return
+	}
+
+	result, err := paymentGateway.Confirm(payment.Reference, input.ChallengeCode)
+	if err != nil {
+		log.Printf("Payment gateway error for payment %d: %v", payment.ID, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE payments SET status = ?, failure_reason = NULLIF(?, ''), completed_at = NOW() WHERE id = ?",
+		result.Status, result.FailureReason, payment.ID)
+	if err != nil {
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+	switch result.Status {
+	case paymentSucceeded:
+		if err := markBillingPaid(tx, billing, accountCash, payment.Reference); err != nil {
+			http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+			return
+		}
+	case paymentDeclined:
+		// A failed challenge is retried on the dunning schedule like any decline
+		if err := openDunning(tx, billing, payment.ID); err != nil {
+			log.Printf("Failed to start dunning for billing %d: %v", billing.ID, err)
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+
+	payment, err = scanPayment(billingDB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", payment.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(payment.Status))
+	json.NewEncoder(w).Encode(payment)
+}
+
+// List every payment attempt made for a billing
+func getPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	rows, err := billingDB.Query("SELECT "+paymentColumns+" FROM payments WHERE billing_id = ? ORDER BY id", billingID)
+	if err != nil {
+		http.Error(w, "Failed to fetch payments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse payment data", http.StatusInternalServerError)
+			return
+		}
+		payments = append(payments, payment)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payments)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Staff roles allowed to view and manage any customer's billing
+var billingStaffRoles = []string{roleBillingAdmin, roleSupport}
+
+// authorizeUserAccess checks that the caller is the given user or billing staff.
+// It writes a 403 response and returns false otherwise.
+func authorizeUserAccess(w http.ResponseWriter, r *http.Request, userID int) bool {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok || !claims.canAccessUser(userID, billingStaffRoles...) {
+		http.Error(w, "You do not have access to this billing", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Staff roles allowed to settle any customer's reservation. Vehicle_Management
+// calls these endpoints with the token of whoever changed the reservation, so
+// the fleet admins who run reservations there are let in as well.
+var reservationStaffRoles = append([]string{roleFleetAdmin}, billingStaffRoles...)
+
+// authorizeReservationAccess checks that the caller is the given user or
+// reservation staff. It writes a 403 response and returns false otherwise.
+func authorizeReservationAccess(w http.ResponseWriter, r *http.Request, userID int) bool {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok || !claims.canAccessUser(userID, reservationStaffRoles...) {
+		http.Error(w, "You do not have access to this reservation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeBillingAccess resolves the customer behind a billing through its
+// reservation and checks the caller may see it. It writes the error response
+// and returns false otherwise.
+func authorizeBillingAccess(w http.ResponseWriter, r *http.Request, billingID string) bool {
+	if claims, ok := claimsFromContext(r.Context()); ok && claims.hasRole(billingStaffRoles...) {
+		return true
+	}
+
+	var reservationID, ownerID int
+	err := billingDB.QueryRow("SELECT reservation_id FROM billings WHERE id = ?", billingID).Scan(&reservationID)
+	if err == nil {
+		err = vehicleDB.QueryRow("SELECT user_id FROM reservations WHERE id = ?", reservationID).Scan(&ownerID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Billing not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	return authorizeUserAccess(w, r, ownerID)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// requestAs is a request carrying the claims authMiddleware would store for the caller
+func requestAs(userID int, role string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/billings", nil)
+	claims := &Claims{UserID: userID, MembershipTier: "Basic", Role: role}
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+}
+
+func TestAuthorizeReservationAccess(t *testing.T) {
+	const ownerID = 7
+	tests := []struct {
+		name   string
+		userID int
+		role   string
+		want   bool
+	}{
+		{"owner", ownerID, roleCustomer, true},
+		{"other customer", 8, roleCustomer, false},
+		{"fleet admin", 1, roleFleetAdmin, true},
+		{"billing admin", 1, roleBillingAdmin, true},
+		{"support", 1, roleSupport, true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if got := authorizeReservationAccess(w, requestAs(tt.userID, tt.role), ownerID); got != tt.want {
+			t.Errorf("%s: authorizeReservationAccess = %v, want %v", tt.name, got, tt.want)
+		}
+		if !tt.want && w.Code != http.StatusForbidden {
+			t.Errorf("%s: response code = %d, want 403", tt.name, w.Code)
+		}
+	}
+}
+
+func TestFleetAdminIsNotBillingStaff(t *testing.T) {
+	w := httptest.NewRecorder()
+	if authorizeUserAccess(w, requestAs(1, roleFleetAdmin), 7) {
+		t.Error("fleet admin was given access to another user's billing")
+	}
+}
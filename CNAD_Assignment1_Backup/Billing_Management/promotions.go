@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const promotionDateLayout = "2006-01-02"
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var (
+	errPromotionNotFound       = errors.New("promotion code not found")
+	errPromotionExpired        = errors.New("promotion code has expired")
+	errPromotionAlreadyUsed    = errors.New("promotion code has already been used by this user")
+	errPromotionExhausted      = errors.New("promotion code has reached its usage limit")
+	errPromotionMinimumSpend   = errors.New("booking does not meet the promotion's minimum spend")
+	errPromotionNotBetter      = errors.New("promotion does not beat the membership discount")
+	errPromotionAlreadyApplied = errors.New("billing already has a promotion applied")
+	errBillingNotPending       = errors.New("billing is not awaiting payment")
+)
+
+// Promotion is a discount code customers can redeem against a billing.
+// Stackable promotions apply on top of the membership discount; the others
+// replace it, and are only accepted when they give the customer a better price.
+type Promotion struct {
+	ID                 int    `json:"id"`
+	Code               string `json:"code"`
+	DiscountPercentage int    `json:"discount_percentage"`
+	ExpirationDate     string `json:"expiration_date"` // YYYY-MM-DD, last day the code is valid
+	MaxUses            *int   `json:"max_uses"`        // nil for unlimited
+	MinimumSpend       Money  `json:"minimum_spend"`   // in the default currency
+	Stackable          bool   `json:"stackable"`
+	TimesUsed          int    `json:"times_used"`
+}
+
+const promotionColumns = `id, code, discount_percentage, DATE_FORMAT(expiration_date, '%Y-%m-%d'), max_uses, minimum_spend, stackable,
+	(SELECT COUNT(*) FROM promotion_redemptions pr WHERE pr.promotion_id = promotions.id)`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (Promotion, error) {
+	var p Promotion
+	var maxUses sql.NullInt64
+	var minimumSpend moneyColumn
+	err := row.Scan(&p.ID, &p.Code, &p.DiscountPercentage, &p.ExpirationDate, &maxUses, &minimumSpend, &p.Stackable, &p.TimesUsed)
+	if err != nil {
+		return p, err
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		p.MaxUses = &n
+	}
+	p.MinimumSpend, err = minimumSpend.money(defaultCurrency)
+	return p, err
+}
+
+// normalizePromoCode makes codes case-insensitive for customers
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validatePromotion checks the fields an admin may set on a promotion
+func validatePromotion(p Promotion) string {
+	if _, err := time.Parse(promotionDateLayout, p.ExpirationDate); err != nil {
+		return "Expiration date must be in YYYY-MM-DD format"
+	}
+	switch {
+	case p.Code == "" || len(p.Code) > 255:
+		return "Code must be between 1 and 255 characters"
+	case p.DiscountPercentage <= 0 || p.DiscountPercentage > 100:
+		return "Discount percentage must be between 1 and 100"
+	case p.MaxUses != nil && *p.MaxUses < 1:
+		return "Max uses must be at least 1"
+	case p.MinimumSpend.Currency != defaultCurrency:
+		return "Minimum spend must be in " + defaultCurrency
+	case p.MinimumSpend.Minor < 0:
+		return "Minimum spend cannot be negative"
+	}
+	return ""
+}
+
+// promotionDiscount works out how much a promotion takes off a booking that
+// costs base before any discount and cost after the membership discount
+func promotionDiscount(p Promotion, base, cost Money) (Money, error) {
+	// Minimum spends are set in the default currency
+	minimumSpend, err := convertMoney(p.MinimumSpend, cost.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if cost.LessThan(minimumSpend) {
+		return Money{}, errPromotionMinimumSpend
+	}
+	percentage := float64(p.DiscountPercentage)
+	if p.Stackable {
+		return cost.Percent(percentage), nil
+	}
+
+	// The promotion replaces the membership discount
+	discounted := base.Sub(base.Percent(percentage))
+	if !discounted.LessThan(cost) {
+		return Money{}, errPromotionNotBetter
+	}
+	return cost.Sub(discounted), nil
+}
+
+// checkPromotion loads a promotion by code and checks that userID may still redeem it.
+// Pass a transaction with lock set to hold the promotion row until the redemption is recorded.
+func checkPromotion(q queryRower, code string, userID int, lock bool) (Promotion, error) {
+	query := "SELECT " + promotionColumns + " FROM promotions WHERE code = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	p, err := scanPromotion(q.QueryRow(query, normalizePromoCode(code)))
+	if err == sql.ErrNoRows {
+		return p, errPromotionNotFound
+	} else if err != nil {
+		return p, err
+	}
+
+	if time.Now().Format(promotionDateLayout) > p.ExpirationDate {
+		return p, errPromotionExpired
+	}
+	if p.MaxUses != nil && p.TimesUsed >= *p.MaxUses {
+		return p, errPromotionExhausted
+	}
+
+	var used int
+	err = q.QueryRow("SELECT COUNT(*) FROM promotion_redemptions WHERE promotion_id = ? AND user_id = ?", p.ID, userID).Scan(&used)
+	if err != nil {
+		return p, err
+	}
+	if used > 0 {
+		return p, errPromotionAlreadyUsed
+	}
+	return p, nil
+}
+
+// redeemPromotion applies a promotion code to a billing inside tx and returns
+// the discount. The caller updates the billing amount and commits.
+func redeemPromotion(tx *sql.Tx, code string, billing Billing, base Money) (Money, error) {
+	p, err := checkPromotion(tx, code, billing.UserID, true)
+	if err != nil {
+		return Money{}, err
+	}
+	discount, err := promotionDiscount(p, base, billing.preTaxAmount())
+	if err != nil {
+		return Money{}, err
+	}
+	return discount, recordRedemption(tx, p.ID, billing, discount)
+}
+
+// redeemQuotedPromotion honours the promotion of the quote a reservation was
+// booked with and returns the discount. The promotion is checked again under
+// its row lock, since it may have expired or run out since the quote was
+// issued; the booking is then billed without it rather than failing.
+func redeemQuotedPromotion(tx *sql.Tx, quote *QuoteClaims, billing Billing) (Money, error) {
+	p, err := checkPromotion(tx, quote.PromoCode, billing.UserID, true)
+	if isPromotionError(err) {
+		log.Printf("Billing reservation %d without quoted promotion %s: %v", billing.ReservationID, quote.PromoCode, err)
+		return zeroMoney(billing.Amount.Currency), nil
+	} else if err != nil {
+		return Money{}, err
+	}
+	discount := quote.promoDiscount()
+	return discount, recordRedemption(tx, p.ID, billing, discount)
+}
+
+// recordRedemption stores a promotion's use against a billing
+func recordRedemption(tx *sql.Tx, promotionID int, billing Billing, discount Money) error {
+	_, err := tx.Exec("INSERT INTO promotion_redemptions (promotion_id, user_id, billing_id, discount_amount) VALUES (?, ?, ?, ?)",
+		promotionID, billing.UserID, billing.ID, discount)
+	if err != nil && strings.Contains(err.Error(), "Duplicate entry") {
+		// Either this billing has a promotion or the user redeemed this one concurrently
+		var count int
+		tx.QueryRow("SELECT COUNT(*) FROM promotion_redemptions WHERE billing_id = ?", billing.ID).Scan(&count)
+		if count > 0 {
+			return errPromotionAlreadyApplied
+		}
+		return errPromotionAlreadyUsed
+	}
+	return err
+}
+
+// isPromotionError reports whether err means the promotion code was rejected
+func isPromotionError(err error) bool {
+	for _, target := range []error{errPromotionNotFound, errPromotionExpired, errPromotionAlreadyUsed, errPromotionExhausted,
+		errPromotionMinimumSpend, errPromotionNotBetter, errPromotionAlreadyApplied} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePromotionError maps promotion errors to HTTP responses
+func writePromotionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPromotionNotFound):
+		http.Error(w, "Promotion code not found", http.StatusNotFound)
+	case errors.Is(err, errPromotionExpired):
+		http.Error(w, "Promotion code has expired", http.StatusUnprocessableEntity)
+	case errors.Is(err, errPromotionMinimumSpend):
+		http.Error(w, "Booking does not meet the minimum spend for this promotion", http.StatusUnprocessableEntity)
+	case errors.Is(err, errPromotionNotBetter):
+		http.Error(w, "Promotion does not beat your membership discount", http.StatusUnprocessableEntity)
+	case errors.Is(err, errPromotionAlreadyUsed):
+		http.Error(w, "Promotion code has already been used", http.StatusConflict)
+	case errors.Is(err, errPromotionExhausted):
+		http.Error(w, "Promotion code is no longer available", http.StatusConflict)
+	case errors.Is(err, errPromotionAlreadyApplied):
+		http.Error(w, "A promotion has already been applied to this billing", http.StatusConflict)
+	case errors.Is(err, errBillingNotPending):
+		http.Error(w, "Promotions can only be applied to unpaid billings", http.StatusConflict)
+	default:
+		log.Printf("Failed to apply promotion: %v", err)
+		http.Error(w, "Failed to apply promotion", http.StatusInternalServerError)
+	}
+}
+
+// Apply a promotion code to an unpaid billing
+func applyPromoHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || strings.TrimSpace(input.Code) == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE id = ? FOR UPDATE", billingID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Billing not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch billing data", http.StatusInternalServerError)
+		return
+	}
+	// Cancellation fees are not discounted
+	if billing.PaymentStatus != billingPending || billing.CancellationFee != nil {
+		writePromotionError(w, errBillingNotPending)
+		return
+	}
+
+	d, err := loadReservation(billing.ReservationID)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	d.Currency = billing.Amount.Currency
+	base, err := reservationBaseCost(d)
+	if err != nil {
+		http.Error(w, "Failed to price reservation", http.StatusInternalServerError)
+		return
+	}
+
+	discount, err := redeemPromotion(tx, input.Code, billing, base)
+	if err != nil {
+		writePromotionError(w, err)
+		return
+	}
+	taxRate, err := taxRateFor(d.Location)
+	if err != nil {
+		http.Error(w, "Failed to fetch tax rate", http.StatusInternalServerError)
+		return
+	}
+	before := billing
+	setBillingPrice(&billing, billing.preTaxAmount().Sub(discount), taxRate)
+	if _, err := tx.Exec("UPDATE billings SET amount = ?, tax_amount = ?, tax_inclusive = ? WHERE id = ?",
+		billing.Amount, billing.TaxAmount, billing.TaxInclusive, billing.ID); err != nil {
+		http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+		return
+	}
+	if err := postReprice(tx, ledgerPromotion, "Promotion "+normalizePromoCode(input.Code), accountPromotions, before, billing); err != nil {
+		log.Printf("Failed to post promotion of billing %d: %v", billing.ID, err)
+		http.Error(w, "Failed to update billing", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to apply promotion", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"billing":  billing,
+		"discount": discount,
+	})
+}
+
+func getPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rows, err := billingDB.Query("SELECT " + promotionColumns + " FROM promotions ORDER BY expiration_date DESC, id DESC")
+	if err != nil {
+		http.Error(w, "Failed to fetch promotions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	promotions := []Promotion{}
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse promotion data", http.StatusInternalServerError)
+			return
+		}
+		promotions = append(promotions, p)
+	}
+	json.NewEncoder(w).Encode(promotions)
+}
+
+func getPromotionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := scanPromotion(billingDB.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = ?", mux.Vars(r)["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Promotion not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch promotion", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+func createPromotionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var p Promotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	p.Code = normalizePromoCode(p.Code)
+	p.MinimumSpend, _ = p.MinimumSpend.inCurrency(defaultCurrency)
+	if msg := validatePromotion(p); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	res, err := billingDB.Exec("INSERT INTO promotions (code, discount_percentage, expiration_date, max_uses, minimum_spend, stackable) VALUES (?, ?, ?, ?, ?, ?)",
+		p.Code, p.DiscountPercentage, p.ExpirationDate, p.MaxUses, p.MinimumSpend, p.Stackable)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			http.Error(w, "Promotion code already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create promotion", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	p.ID = int(id)
+	p.TimesUsed = 0
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func updatePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	var p Promotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	p.Code = normalizePromoCode(p.Code)
+	p.MinimumSpend, _ = p.MinimumSpend.inCurrency(defaultCurrency)
+	if msg := validatePromotion(p); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := scanPromotion(billingDB.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = ?", id)); err == sql.ErrNoRows {
+		http.Error(w, "Promotion not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch promotion", http.StatusInternalServerError)
+		return
+	}
+
+	_, err := billingDB.Exec("UPDATE promotions SET code = ?, discount_percentage = ?, expiration_date = ?, max_uses = ?, minimum_spend = ?, stackable = ? WHERE id = ?",
+		p.Code, p.DiscountPercentage, p.ExpirationDate, p.MaxUses, p.MinimumSpend, p.Stackable, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			http.Error(w, "Promotion code already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update promotion", http.StatusInternalServerError)
+		return
+	}
+
+	p, err = scanPromotion(billingDB.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "Failed to fetch promotion", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Delete a promotion that has never been redeemed. Redeemed promotions are kept
+// for the billing history; set their expiration date to retire them instead.
+func deletePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	var redemptions int
+	if err := billingDB.QueryRow("SELECT COUNT(*) FROM promotion_redemptions WHERE promotion_id = ?", id).Scan(&redemptions); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if redemptions > 0 {
+		http.Error(w, "Promotion has been redeemed and cannot be deleted", http.StatusConflict)
+		return
+	}
+
+	res, err := billingDB.Exec("DELETE FROM promotions WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Promotion not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Promotion deleted successfully"})
+}
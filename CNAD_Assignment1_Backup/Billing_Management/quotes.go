@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How long a quote can be used to book at the quoted price
+var quoteTTLMinutes = getEnvInt("QUOTE_TTL_MINUTES", 15)
+
+// PriceBreakdown itemises what a booking costs
+type PriceBreakdown struct {
+	Hours              float64 `json:"hours"`
+	HourlyRate         Money   `json:"hourly_rate"`
+	BaseAmount         Money   `json:"base_amount"`
+	MembershipDiscount Money   `json:"membership_discount"`
+	PromoCode          string  `json:"promo_code,omitempty"`
+	PromoDiscount      Money   `json:"promo_discount"`
+	TaxDescription     string  `json:"tax_description,omitempty"`
+	Taxes              Money   `json:"taxes"`
+	Fees               Money   `json:"fees"`
+	Total              Money   `json:"total"`
+}
+
+// Quote is the response of GET /quotes. Pass QuoteID as quote_id when creating
+// the reservation to lock the price in.
+type Quote struct {
+	QuoteID        string    `json:"quote_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	VehicleID      int       `json:"vehicle_id"`
+	UserID         int       `json:"user_id"`
+	StartTime      string    `json:"start_time"`
+	EndTime        string    `json:"end_time"`
+	VehicleType    string    `json:"vehicle_type"`
+	MembershipTier string    `json:"membership_tier"`
+	Currency       string    `json:"currency"` // every amount of the quote is in this currency
+	PriceBreakdown
+}
+
+// priceBreakdown prices a booking with the same rules used to bill it:
+// reservationBaseCost and reservationCost, then the promotion if one is given,
+// then the tax of the vehicle's location, which is returned with the price
+func priceBreakdown(d reservationDetails, promoCode string) (PriceBreakdown, TaxRate, error) {
+	var price PriceBreakdown
+	var taxRate TaxRate
+
+	hourlyRate, err := getVehiclePricing(d.VehicleType, d.Currency)
+	if err != nil {
+		return price, taxRate, err
+	}
+	base, err := reservationBaseCost(d)
+	if err != nil {
+		return price, taxRate, err
+	}
+	cost, err := reservationCost(d)
+	if err != nil {
+		return price, taxRate, err
+	}
+
+	price.Hours = d.EndTime.Sub(d.StartTime).Hours()
+	price.HourlyRate = hourlyRate
+	price.BaseAmount = base
+	price.MembershipDiscount = base.Sub(cost)
+	price.PromoDiscount = zeroMoney(cost.Currency)
+	price.Fees = zeroMoney(cost.Currency)
+	price.Total = cost
+
+	if promoCode != "" {
+		p, err := checkPromotion(billingDB, promoCode, d.UserID, false)
+		if err != nil {
+			return price, taxRate, err
+		}
+		discount, err := promotionDiscount(p, base, cost)
+		if err != nil {
+			return price, taxRate, err
+		}
+		price.PromoCode = p.Code
+		price.PromoDiscount = discount
+		price.Total = cost.Sub(discount)
+	}
+
+	taxRate, err = taxRateFor(d.Location)
+	if err != nil {
+		return price, taxRate, err
+	}
+	price.Total, price.Taxes = taxRate.apply(price.Total)
+	if !price.Taxes.IsZero() {
+		price.TaxDescription = taxRate.description()
+	}
+	return price, taxRate, nil
+}
+
+// issueQuoteToken signs the quoted price of a booking and the tax rate it was
+// quoted with
+func issueQuoteToken(d reservationDetails, price PriceBreakdown, taxRate TaxRate, expiresAt time.Time) (string, error) {
+	claims := QuoteClaims{
+		VehicleID:          d.VehicleID,
+		UserID:             d.UserID,
+		StartTime:          d.StartTime.Format(reservationTimeLayouts[0]),
+		EndTime:            d.EndTime.Format(reservationTimeLayouts[0]),
+		Currency:           price.BaseAmount.Currency,
+		AmountMinor:        price.BaseAmount.Sub(price.MembershipDiscount).Minor,
+		PromoCode:          price.PromoCode,
+		PromoDiscountMinor: price.PromoDiscount.Minor,
+		TaxName:            taxRate.Name,
+		TaxRate:            taxRate.Rate,
+		TaxPricingMode:     taxRate.PricingMode,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    quoteIssuer,
+			Subject:   strconv.Itoa(d.UserID),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+// amount is the quoted price after the membership discount
+func (q *QuoteClaims) amount() Money {
+	return Money{Minor: q.AmountMinor, Currency: q.Currency}
+}
+
+// promoDiscount is what the quoted promotion takes off amount
+func (q *QuoteClaims) promoDiscount() Money {
+	return Money{Minor: q.PromoDiscountMinor, Currency: q.Currency}
+}
+
+// taxRate is the tax the quote was priced with, so that a rate changed since
+// does not change the quoted total. Quotes issued before the rate was signed
+// into them have no pricing mode and are taxed at the current rate.
+func (q *QuoteClaims) taxRate(jurisdiction string) (TaxRate, error) {
+	if q.TaxPricingMode == "" {
+		return taxRateFor(jurisdiction)
+	}
+	return TaxRate{Jurisdiction: jurisdiction, Name: q.TaxName, Rate: q.TaxRate, PricingMode: q.TaxPricingMode}, nil
+}
+
+// Quote the price of a booking before it is made
+func getQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	vehicleID, err := strconv.Atoi(query.Get("vehicle_id"))
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeUserAccess(w, r, userID) {
+		return
+	}
+
+	d := reservationDetails{VehicleID: vehicleID, UserID: userID}
+	if d.StartTime, err = parseReservationTime(query.Get("start_time")); err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+	if d.EndTime, err = parseReservationTime(query.Get("end_time")); err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+	if !d.EndTime.After(d.StartTime) {
+		http.Error(w, "End time must be after start time", http.StatusBadRequest)
+		return
+	}
+
+	err = vehicleDB.QueryRow("SELECT vehicle_type, location FROM vehicles WHERE id = ?", vehicleID).Scan(&d.VehicleType, &d.Location)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch vehicle", http.StatusInternalServerError)
+		return
+	}
+	err = loadCustomer(&d)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	price, taxRate, err := priceBreakdown(d, query.Get("promo"))
+	if isPromotionError(err) {
+		writePromotionError(w, err)
+		return
+	} else if err != nil {
+		log.Printf("Failed to price quote: %v", err)
+		http.Error(w, "Failed to price booking", http.StatusInternalServerError)
+		return
+	}
+
+	quote := Quote{
+		ExpiresAt:      time.Now().Add(time.Duration(quoteTTLMinutes) * time.Minute).Truncate(time.Second),
+		VehicleID:      vehicleID,
+		UserID:         userID,
+		StartTime:      d.StartTime.Format(reservationTimeLayouts[0]),
+		EndTime:        d.EndTime.Format(reservationTimeLayouts[0]),
+		VehicleType:    d.VehicleType,
+		MembershipTier: d.MembershipTier,
+		Currency:       d.Currency,
+		PriceBreakdown: price,
+	}
+	if quote.QuoteID, err = issueQuoteToken(d, price, taxRate, quote.ExpiresAt); err != nil {
+		http.Error(w, "Failed to sign quote", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuoteTokenKeepsTaxRate(t *testing.T) {
+	secret := jwtSecret
+	jwtSecret = []byte("test-secret")
+	t.Cleanup(func() { jwtSecret = secret })
+
+	start := time.Date(2026, 1, 5, 9, 0, 0, 0, time.Local)
+	d := reservationDetails{VehicleID: 3, UserID: 7, StartTime: start, EndTime: start.Add(2 * time.Hour), Location: "SG"}
+	price := PriceBreakdown{
+		BaseAmount:         Money{Minor: 10000, Currency: "SGD"},
+		MembershipDiscount: Money{Minor: 500, Currency: "SGD"},
+		PromoDiscount:      zeroMoney("SGD"),
+	}
+	quotedRate := TaxRate{Jurisdiction: "SG", Name: "GST", Rate: 9, PricingMode: taxExclusive}
+
+	token, err := issueQuoteToken(d, price, quotedRate, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("issueQuoteToken: %v", err)
+	}
+	quote, err := parseQuoteToken(token, true)
+	if err != nil {
+		t.Fatalf("parseQuoteToken: %v", err)
+	}
+	// Read from the quote, not tax_rates, so a rate changed since does not apply
+	rate, err := quote.taxRate("SG")
+	if err != nil {
+		t.Fatalf("taxRate: %v", err)
+	}
+	if rate != quotedRate {
+		t.Errorf("quoted tax rate = %+v, want %+v", rate, quotedRate)
+	}
+
+	total, _ := rate.apply(quote.amount())
+	if want := (Money{Minor: 10355, Currency: "SGD"}); total != want {
+		t.Errorf("billed total = %s, want the quoted %s", total, want)
+	}
+}
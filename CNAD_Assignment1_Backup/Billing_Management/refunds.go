@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Reason codes stored in refunds.reason_code
+const (
+	refundReservationCancelled = "reservation_cancelled"
+	refundServiceIssue         = "service_issue"
+	refundDuplicateCharge      = "duplicate_charge"
+	refundGoodwill             = "goodwill"
+	refundOther                = "other"
+)
+
+var validRefundReasons = map[string]bool{
+	refundReservationCancelled: true,
+	refundServiceIssue:         true,
+	refundDuplicateCharge:      true,
+	refundGoodwill:             true,
+	refundOther:                true,
+}
+
+var (
+	errBillingNotPaid       = errors.New("billing has not been paid")
+	errRefundExceedsBalance = errors.New("refund exceeds the refundable balance")
+)
+
+// Refund is money returned to the customer against a paid billing
+type Refund struct {
+	ID         int    `json:"id"`
+	BillingID  int    `json:"billing_id"`
+	PaymentID  int    `json:"payment_id"`
+	Amount     Money  `json:"amount"`
+	ReasonCode string `json:"reason_code"`
+	Note       string `json:"note,omitempty"`
+	Reference  string `json:"gateway_reference"`
+	CreatedAt  string `json:"created_at"`
+}
+
+const refundColumns = "id, billing_id, payment_id, currency, amount, reason_code, COALESCE(note, ''), gateway_reference, created_at"
+
+func scanRefund(row interface{ Scan(...interface{}) error }) (Refund, error) {
+	var rf Refund
+	var currency string
+	var amount moneyColumn
+	err := row.Scan(&rf.ID, &rf.BillingID, &rf.PaymentID, &currency, &amount, &rf.ReasonCode, &rf.Note, &rf.Reference, &rf.CreatedAt)
+	if err != nil {
+		return rf, err
+	}
+	rf.Amount, err = amount.money(currency)
+	return rf, err
+}
+
+// refundableBalance locks the billing and returns what has been paid and not yet refunded
+func refundableBalance(tx *sql.Tx, billingID int) (Money, error) {
+	var currency, status string
+	var amount, refunded moneyColumn
+	err := tx.QueryRow("SELECT currency, amount, payment_status FROM billings WHERE id = ? FOR UPDATE", billingID).Scan(&currency, &amount, &status)
+	if err != nil {
+		return Money{}, err
+	}
+	if status != billingPaid && status != billingPartiallyRefunded {
+		return Money{}, errBillingNotPaid
+	}
+
+	if err := tx.QueryRow("SELECT SUM(amount) FROM refunds WHERE billing_id = ?", billingID).Scan(&refunded); err != nil {
+		return Money{}, err
+	}
+	paid, err := amount.money(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	refundedAmount, err := refunded.money(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return paid.Sub(refundedAmount), nil
+}
+
+// issueRefund refunds amount of a paid billing through the gateway that took
+// the payment, or into the wallet it was paid from, records it and moves the billing to Refunded or PartiallyRefunded.
+// The amount must be in the currency of the billing.
+func issueRefund(billingID int, amount Money, reasonCode, note string) (Refund, error) {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return Refund{}, err
+	}
+	defer tx.Rollback()
+
+	refundID, err := refundInTx(tx, billingID, amount, reasonCode, note)
+	if err != nil {
+		return Refund{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Refund{}, err
+	}
+	return scanRefund(billingDB.QueryRow("SELECT "+refundColumns+" FROM refunds WHERE id = ?", refundID))
+}
+
+// refundInTx is issueRefund inside tx, which takes the billing row lock. It
+// returns the id of the new refund; the caller commits.
+func refundInTx(tx *sql.Tx, billingID int, amount Money, reasonCode, note string) (int64, error) {
+	balance, err := refundableBalance(tx, billingID)
+	if err != nil {
+		return 0, err
+	}
+	if amount.Currency != balance.Currency {
+		return 0, errCurrencyMismatch
+	}
+	if !amount.IsPositive() || balance.LessThan(amount) {
+		return 0, errRefundExceedsBalance
+	}
+
+	var userID, paymentID int
+	var method, paymentReference string
+	if err := tx.QueryRow("SELECT user_id FROM billings WHERE id = ?", billingID).Scan(&userID); err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT id, method, gateway_reference FROM payments WHERE billing_id = ? AND status = ? ORDER BY id DESC LIMIT 1",
+		billingID, paymentSucceeded).Scan(&paymentID, &method, &paymentReference)
+	if err == sql.ErrNoRows {
+		return 0, errBillingNotPaid
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Wallet payments are refunded back into the wallet
+	var reference string
+	account := accountCash
+	if method == methodWallet {
+		transactionID, err := adjustWallet(tx, userID, amount, walletRefund, billingID, 0, note, 0)
+		if err != nil {
+			return 0, err
+		}
+		reference, account = walletReference(transactionID), walletAccount(userID)
+	} else if reference, err = paymentGateway.Refund(paymentReference, amount); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("INSERT INTO refunds (billing_id, payment_id, currency, amount, reason_code, note, gateway_reference) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)",
+		billingID, paymentID, amount.Currency, amount, reasonCode, note, reference)
+	if err != nil {
+		return 0, err
+	}
+	refundID, _ := res.LastInsertId()
+
+	if err := postRefund(tx, userID, billingID, amount, account, reasonCode); err != nil {
+		return 0, err
+	}
+
+	status := billingPartiallyRefunded
+	if amount == balance {
+		status = billingRefunded
+	}
+	if _, err := tx.Exec("UPDATE billings SET payment_status = ? WHERE id = ?", status, billingID); err != nil {
+		return 0, err
+	}
+	return refundID, nil
+}
+
+// writeRefundError maps refund errors to HTTP responses
+func writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Billing not found", http.StatusNotFound)
+	case errors.Is(err, errBillingNotPaid):
+		http.Error(w, "Billing has not been paid", http.StatusConflict)
+	case errors.Is(err, errCurrencyMismatch):
+		http.Error(w, "Refund must be in the currency of the billing", http.StatusBadRequest)
+	case errors.Is(err, errRefundExceedsBalance):
+		http.Error(w, "Refund amount must be positive and no more than the refundable balance", http.StatusUnprocessableEntity)
+	default:
+		log.Printf("Failed to issue refund: %v", err)
+		http.Error(w, "Failed to issue refund", http.StatusInternalServerError)
+	}
+}
+
+// Refund all or part of a paid billing. Omitting amount refunds the remaining balance.
+func createRefundHandler(w http.ResponseWriter, r *http.Request) {
+	billingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid billing ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Amount     *Money `json:"amount"`
+		ReasonCode string `json:"reason_code"`
+		Note       string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if !validRefundReasons[input.ReasonCode] {
+		http.Error(w, "Invalid reason code", http.StatusBadRequest)
+		return
+	}
+
+	// The balance gives the currency of the billing, and the amount when none is given
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	amount, err := refundableBalance(tx, billingID)
+	tx.Rollback()
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+	if input.Amount != nil {
+		var ok bool
+		if amount, ok = input.Amount.inCurrency(amount.Currency); !ok {
+			writeRefundError(w, errCurrencyMismatch)
+			return
+		}
+	}
+
+	refund, err := issueRefund(billingID, amount, input.ReasonCode, input.Note)
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(refund)
+}
+
+func getRefundsHandler(w http.ResponseWriter, r *http.Request) {
+	billingID := mux.Vars(r)["id"]
+	if !authorizeBillingAccess(w, r, billingID) {
+		return
+	}
+
+	rows, err := billingDB.Query("SELECT "+refundColumns+" FROM refunds WHERE billing_id = ? ORDER BY id", billingID)
+	if err != nil {
+		http.Error(w, "Failed to fetch refunds", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse refund data", http.StatusInternalServerError)
+			return
+		}
+		refunds = append(refunds, refund)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refunds)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RescheduleSettlement is what Billing_Management changed for a rescheduled reservation
+type RescheduleSettlement struct {
+	ReservationID int      `json:"reservation_id"`
+	Billing       *Billing `json:"billing"` // the repriced billing, nil if there was none to reprice
+}
+
+// repriceReschedule prices an unpaid billing again for the reservation's new
+// window. A promotion redeemed against it is recalculated, and dropped if it
+// no longer applies. Paid, cancelled and unbilled reservations are left alone:
+// a paid booking keeps the price it was paid at.
+func repriceReschedule(d reservationDetails) (*Billing, error) {
+	tx, err := billingDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	billing, err := scanBilling(tx.QueryRow("SELECT "+billingColumns+" FROM billings WHERE reservation_id = ? FOR UPDATE", d.ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if billing.PaymentStatus != billingPending || billing.CancellationFee != nil {
+		return nil, nil
+	}
+
+	d.Currency = billing.Amount.Currency
+	cost, err := reservationCost(d)
+	if err != nil {
+		return nil, err
+	}
+	base, err := reservationBaseCost(d)
+	if err != nil {
+		return nil, err
+	}
+	taxRate, err := taxRateFor(d.Location)
+	if err != nil {
+		return nil, err
+	}
+	// A late return charge already assessed stays on the billing
+	overtime := zeroMoney(billing.Amount.Currency)
+	if billing.OvertimeFee != nil {
+		overtime = *billing.OvertimeFee
+	}
+
+	var promotionID int
+	var redeemed moneyColumn
+	oldDiscount, newDiscount := zeroMoney(cost.Currency), zeroMoney(cost.Currency)
+	err = tx.QueryRow("SELECT promotion_id, discount_amount FROM promotion_redemptions WHERE billing_id = ? FOR UPDATE", billing.ID).Scan(&promotionID, &redeemed)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		if oldDiscount, err = redeemed.money(cost.Currency); err != nil {
+			return nil, err
+		}
+		p, err := scanPromotion(tx.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = ?", promotionID))
+		if err != nil {
+			return nil, err
+		}
+		newDiscount, err = promotionDiscount(p, base, cost)
+		if isPromotionError(err) {
+			log.Printf("Dropping promotion %s from billing %d: %v", p.Code, billing.ID, err)
+			newDiscount = zeroMoney(cost.Currency)
+			_, err = tx.Exec("DELETE FROM promotion_redemptions WHERE billing_id = ?", billing.ID)
+		} else if err == nil {
+			_, err = tx.Exec("UPDATE promotion_redemptions SET discount_amount = ? WHERE billing_id = ?", newDiscount, billing.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The change in rental price and the change in promotion are posted apart,
+	// like the charge and promotion credit of a new billing
+	repriced := billing
+	setBillingPrice(&repriced, cost.Sub(oldDiscount).Add(overtime), taxRate)
+	if err := postReprice(tx, ledgerAdjustment, "Reservation rescheduled", accountRevenue, billing, repriced); err != nil {
+		return nil, err
+	}
+	discounted := repriced
+	setBillingPrice(&discounted, cost.Sub(newDiscount).Add(overtime), taxRate)
+	if err := postReprice(tx, ledgerPromotion, "Promotion recalculated", accountPromotions, repriced, discounted); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE billings SET amount = ?, tax_amount = ?, tax_inclusive = ? WHERE id = ?",
+		discounted.Amount, discounted.TaxAmount, discounted.TaxInclusive, billing.ID); err != nil {
+		return nil, err
+	}
+	return &discounted, tx.Commit()
+}
+
+// moveDepositRelease keeps the open deposit hold of a rescheduled reservation
+// until DEPOSIT_RELEASE_HOURS after its new end time
+func moveDepositRelease(d reservationDetails) error {
+	releaseAfter := d.EndTime.Add(time.Duration(depositReleaseHours) * time.Hour)
+	_, err := billingDB.Exec("UPDATE deposit_holds SET release_after = ? WHERE reservation_id = ? AND status IN (?, ?)",
+		releaseAfter.Format(mysqlDateTimeLayout), d.ID, holdAuthorized, holdRequiresAction)
+	return err
+}
+
+// Bring the billing and deposit hold of a reservation in line with its new
+// window. Vehicle_Management calls this after rescheduling a reservation;
+// calling it again makes no further change.
+func settleRescheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		ReservationID int `json:"reservation_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	d, err := loadReservation(input.ReservationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeReservationAccess(w, r, d.UserID) {
+		return
+	}
+	if d.Status != "active" {
+		http.Error(w, "Reservation is not active", http.StatusConflict)
+		return
+	}
+
+	settlement := RescheduleSettlement{ReservationID: d.ID}
+	if settlement.Billing, err = repriceReschedule(d); err != nil {
+		log.Printf("Failed to reprice rescheduled reservation %d: %v", d.ID, err)
+		http.Error(w, "Failed to reprice billing", http.StatusInternalServerError)
+		return
+	}
+	if err := moveDepositRelease(d); err != nil {
+		log.Printf("Failed to move deposit release of reservation %d: %v", d.ID, err)
+		http.Error(w, "Failed to update deposit hold", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(settlement)
+}
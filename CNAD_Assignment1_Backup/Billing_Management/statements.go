@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Layout of statement periods, e.g. "2024-05"
+const statementPeriodLayout = "2006-01"
+
+// How often the statements of the last month are looked for
+const statementInterval = time.Hour
+
+// Statement summarises a user's account in one currency over a calendar
+// month in UTC. The balance is what the user owes: charges raise it and payments
+// lower it. Refunds and wallet credits do not change it and are shown for
+// information.
+type Statement struct {
+	ID             int             `json:"id"`
+	UserID         int             `json:"user_id"`
+	Period         string          `json:"period"`
+	Currency       string          `json:"currency"`
+	OpeningBalance Money           `json:"opening_balance"`
+	Charges        Money           `json:"charges"` // after promotions, including fees and adjustments
+	Payments       Money           `json:"payments"`
+	Refunds        Money           `json:"refunds"`
+	Credits        Money           `json:"credits"` // goodwill credited to the wallet
+	ClosingBalance Money           `json:"closing_balance"`
+	GeneratedAt    string          `json:"generated_at"` // UTC
+	Lines          []StatementLine `json:"lines,omitempty"`
+}
+
+// StatementLine is one movement of the balance during the period
+type StatementLine struct {
+	Date        string `json:"date"`
+	Kind        string `json:"kind"`
+	BillingID   *int   `json:"billing_id,omitempty"`
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`  // positive when it raises the balance
+	Balance     Money  `json:"balance"` // after this line
+}
+
+const statementColumns = "id, user_id, period, currency, opening_balance, charges, payments, refunds, credits, closing_balance, CONVERT_TZ(generated_at, @@session.time_zone, '+00:00')"
+
+func scanStatement(row interface{ Scan(...interface{}) error }) (Statement, error) {
+	var s Statement
+	var amounts [6]moneyColumn
+	err := row.Scan(&s.ID, &s.UserID, &s.Period, &s.Currency, &amounts[0], &amounts[1], &amounts[2], &amounts[3], &amounts[4], &amounts[5], &s.GeneratedAt)
+	if err != nil {
+		return s, err
+	}
+	for i, m := range []*Money{&s.OpeningBalance, &s.Charges, &s.Payments, &s.Refunds, &s.Credits, &s.ClosingBalance} {
+		if *m, err = amounts[i].money(s.Currency); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// periodBounds returns the start of a statement period and of the next one,
+// as DATETIME strings in UTC. Statement periods are UTC months whatever the
+// time zone of the server or the database.
+func periodBounds(period time.Time) (string, string) {
+	start := time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format(mysqlDateTimeLayout), start.AddDate(0, 1, 0).Format(mysqlDateTimeLayout)
+}
+
+// sessionTime converts a UTC DATETIME parameter to the session time zone,
+// which created_at columns are stored in, so period bounds compare correctly
+const sessionTime = "CONVERT_TZ(?, '+00:00', @@session.time_zone)"
+
+// sumMoney runs a query returning a single amount in currency
+func sumMoney(currency, query string, args ...interface{}) (Money, error) {
+	var sum moneyColumn
+	if err := billingDB.QueryRow(query, args...).Scan(&sum); err != nil {
+		return Money{}, err
+	}
+	return sum.money(currency)
+}
+
+// buildStatement totals a user's account in one currency over a period
+func buildStatement(userID int, currency string, period time.Time) (Statement, error) {
+	s := Statement{UserID: userID, Period: period.Format(statementPeriodLayout), Currency: currency}
+	start, end := periodBounds(period)
+	account := customerAccount(userID)
+
+	var err error
+	if s.OpeningBalance, err = sumMoney(currency, `
+		SELECT SUM(l.amount) FROM ledger_lines l JOIN ledger_entries e ON e.id = l.entry_id
+		WHERE l.account = ? AND l.currency = ? AND e.created_at < `+sessionTime, account, currency, start); err != nil {
+		return s, err
+	}
+	if s.Charges, err = sumMoney(currency, `
+		SELECT SUM(l.amount) FROM ledger_lines l JOIN ledger_entries e ON e.id = l.entry_id
+		WHERE l.account = ? AND l.currency = ? AND e.kind <> ? AND e.created_at >= `+sessionTime+` AND e.created_at < `+sessionTime,
+		account, currency, ledgerPayment, start, end); err != nil {
+		return s, err
+	}
+	payments, err := sumMoney(currency, `
+		SELECT SUM(l.amount) FROM ledger_lines l JOIN ledger_entries e ON e.id = l.entry_id
+		WHERE l.account = ? AND l.currency = ? AND e.kind = ? AND e.created_at >= `+sessionTime+` AND e.created_at < `+sessionTime,
+		account, currency, ledgerPayment, start, end)
+	if err != nil {
+		return s, err
+	}
+	s.Payments = payments.Neg()
+	if s.Refunds, err = sumMoney(currency, `
+		SELECT SUM(rf.amount) FROM refunds rf JOIN billings b ON b.id = rf.billing_id
+		WHERE b.user_id = ? AND rf.currency = ? AND rf.created_at >= `+sessionTime+` AND rf.created_at < `+sessionTime,
+		userID, currency, start, end); err != nil {
+		return s, err
+	}
+	if s.Credits, err = sumMoney(currency, `
+		SELECT SUM(amount) FROM wallet_transactions
+		WHERE user_id = ? AND currency = ? AND kind = ? AND created_at >= `+sessionTime+` AND created_at < `+sessionTime,
+		userID, currency, walletCredit, start, end); err != nil {
+		return s, err
+	}
+	s.ClosingBalance = s.OpeningBalance.Add(s.Charges).Sub(s.Payments)
+	return s, nil
+}
+
+// generateStatements stores the statement of every user with a customer
+// account in each currency for a period, skipping accounts with nothing to
+// report and statements already generated. It returns how many were stored.
+// Statements cover what users owe, so users who have only topped up or been
+// credited their wallet, and never been billed, get none; the wallet has its
+// own history at GET /users/{id}/wallet.
+func generateStatements(period time.Time) (int, error) {
+	_, end := periodBounds(period)
+	rows, err := billingDB.Query(`
+		SELECT DISTINCT e.user_id, l.currency
+		FROM ledger_entries e
+		JOIN ledger_lines l ON l.entry_id = e.id
+		WHERE e.created_at < `+sessionTime+` AND l.account = CONCAT('customer:', e.user_id)
+		ORDER BY e.user_id, l.currency`, end)
+	if err != nil {
+		return 0, err
+	}
+	type account struct {
+		userID   int
+		currency string
+	}
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.userID, &a.currency); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	generated := 0
+	for _, a := range accounts {
+		s, err := buildStatement(a.userID, a.currency, period)
+		if err != nil {
+			return generated, err
+		}
+		if s.OpeningBalance.IsZero() && s.Charges.IsZero() && s.Payments.IsZero() && s.Refunds.IsZero() && s.Credits.IsZero() {
+			continue
+		}
+		res, err := billingDB.Exec(`
+			INSERT INTO statements (user_id, period, currency, opening_balance, charges, payments, refunds, credits, closing_balance)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE id = id`,
+			s.UserID, s.Period, s.Currency, s.OpeningBalance, s.Charges, s.Payments, s.Refunds, s.Credits, s.ClosingBalance)
+		if err != nil {
+			return generated, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			generated++
+		}
+	}
+	return generated, nil
+}
+
+// generateStatementsEvery generates the statements of the month before the
+// current one now and then at every interval, so they appear soon after each
+// month ends. It never returns.
+func generateStatementsEvery(interval time.Duration) {
+	for {
+		now := time.Now().UTC()
+		period := now.AddDate(0, 0, -now.Day())
+		n, err := generateStatements(period)
+		if err != nil {
+			log.Printf("Failed to generate statements for %s: %v", period.Format(statementPeriodLayout), err)
+		} else if n > 0 {
+			log.Printf("Generated %d statements for %s", n, period.Format(statementPeriodLayout))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// statementLines lists the ledger movements of a statement's balance, with
+// the running balance after each. Dates are in UTC, like the period.
+func statementLines(s Statement) ([]StatementLine, error) {
+	period, err := time.ParseInLocation(statementPeriodLayout, s.Period, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	start, end := periodBounds(period)
+	rows, err := billingDB.Query(`
+		SELECT CONVERT_TZ(e.created_at, @@session.time_zone, '+00:00'), e.kind, COALESCE(e.billing_id, 0), e.description, l.amount
+		FROM ledger_lines l
+		JOIN ledger_entries e ON e.id = l.entry_id
+		WHERE l.account = ? AND l.currency = ? AND e.created_at >= `+sessionTime+` AND e.created_at < `+sessionTime+`
+		ORDER BY e.id, l.id`, customerAccount(s.UserID), s.Currency, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []StatementLine{}
+	balance := s.OpeningBalance
+	for rows.Next() {
+		var line StatementLine
+		var billingID int
+		var amount moneyColumn
+		if err := rows.Scan(&line.Date, &line.Kind, &billingID, &line.Description, &amount); err != nil {
+			return nil, err
+		}
+		if billingID != 0 {
+			line.BillingID = &billingID
+		}
+		if line.Amount, err = amount.money(s.Currency); err != nil {
+			return nil, err
+		}
+		balance = balance.Add(line.Amount)
+		line.Balance = balance
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// wantsCSV reports whether the client asked for CSV, either with a .csv URL
+// or an Accept header
+func wantsCSV(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, ".csv") || strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// writeStatementCSV sends a statement as a CSV download: the opening balance,
+// every line with the running balance, the closing balance, then the refunds
+// and credits that do not change it
+func writeStatementCSV(w http.ResponseWriter, s Statement) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s.csv"`, s.Period, s.Currency))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "kind", "billing_id", "description", "amount", "balance", "currency"})
+	out.Write([]string{"", "opening_balance", "", "Opening balance", "", s.OpeningBalance.String(), s.Currency})
+	for _, line := range s.Lines {
+		billingID := ""
+		if line.BillingID != nil {
+			billingID = strconv.Itoa(*line.BillingID)
+		}
+		out.Write([]string{line.Date, line.Kind, billingID, line.Description, line.Amount.String(), line.Balance.String(), s.Currency})
+	}
+	out.Write([]string{"", "closing_balance", "", "Closing balance", "", s.ClosingBalance.String(), s.Currency})
+	out.Write([]string{"", "refunds", "", "Refunds issued", s.Refunds.String(), "", s.Currency})
+	out.Write([]string{"", "credits", "", "Wallet credits", s.Credits.String(), "", s.Currency})
+	out.Flush()
+}
+
+// List a user's statements, newest first
+func getStatementsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeUserAccess(w, r, userID) {
+		return
+	}
+
+	rows, err := billingDB.Query("SELECT "+statementColumns+" FROM statements WHERE user_id = ? ORDER BY period DESC, currency", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch statements", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statements := []Statement{}
+	for rows.Next() {
+		s, err := scanStatement(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse statement data", http.StatusInternalServerError)
+			return
+		}
+		statements = append(statements, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statements)
+}
+
+// Get one statement with its lines as JSON, CSV or PDF
+func getStatementHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !authorizeUserAccess(w, r, userID) {
+		return
+	}
+
+	s, err := scanStatement(billingDB.QueryRow("SELECT "+statementColumns+" FROM statements WHERE id = ? AND user_id = ?", vars["statement_id"], userID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Statement not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch statement", http.StatusInternalServerError)
+		return
+	}
+	if s.Lines, err = statementLines(s); err != nil {
+		log.Printf("Failed to list lines of statement %d: %v", s.ID, err)
+		http.Error(w, "Failed to fetch statement lines", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case wantsCSV(r):
+		writeStatementCSV(w, s)
+	case wantsPDF(r):
+		var name, email string
+		if err := userDB.QueryRow("SELECT name, email FROM users WHERE id = ?", userID).Scan(&name, &email); err != nil {
+			http.Error(w, "Failed to fetch customer", http.StatusInternalServerError)
+			return
+		}
+		writePDF(w, fmt.Sprintf("statement-%s-%s.pdf", s.Period, s.Currency), renderStatementPDF(s, name, email))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// Generate the statements of a past month (?period=YYYY-MM), e.g. to backfill
+// months before statements existed. Statements already generated are kept.
+func generateStatementsHandler(w http.ResponseWriter, r *http.Request) {
+	period, err := time.ParseInLocation(statementPeriodLayout, r.URL.Query().Get("period"), time.UTC)
+	if err != nil {
+		http.Error(w, "Period must be in YYYY-MM format", http.StatusBadRequest)
+		return
+	}
+	if _, end := periodBounds(period); end > time.Now().UTC().Format(mysqlDateTimeLayout) {
+		http.Error(w, "Statements can only be generated for months that have ended", http.StatusBadRequest)
+		return
+	}
+
+	n, err := generateStatements(period)
+	if err != nil {
+		log.Printf("Failed to generate statements for %s: %v", period.Format(statementPeriodLayout), err)
+		http.Error(w, "Failed to generate statements", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"period": period.Format(statementPeriodLayout), "generated": n})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Values of tax_rates.pricing_mode
+const (
+	taxExclusive = "exclusive" // tax is added on top of the price
+	taxInclusive = "inclusive" // prices already include the tax
+)
+
+// TaxRate is the tax charged on rentals in one jurisdiction
+type TaxRate struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"tax_name"`
+	Rate         float64 `json:"rate"` // percentage
+	PricingMode  string  `json:"pricing_mode"`
+}
+
+const taxRateColumns = "jurisdiction, tax_name, rate, pricing_mode"
+
+func scanTaxRate(row interface{ Scan(...interface{}) error }) (TaxRate, error) {
+	var t TaxRate
+	err := row.Scan(&t.Jurisdiction, &t.Name, &t.Rate, &t.PricingMode)
+	return t, err
+}
+
+// taxRateFor returns the tax rate of a jurisdiction. Jurisdictions without a
+// row in tax_rates are not taxed and get a zero rate.
+func taxRateFor(jurisdiction string) (TaxRate, error) {
+	t, err := scanTaxRate(billingDB.QueryRow("SELECT "+taxRateColumns+" FROM tax_rates WHERE jurisdiction = ?", jurisdiction))
+	if err == sql.ErrNoRows {
+		return TaxRate{Jurisdiction: jurisdiction, PricingMode: taxExclusive}, nil
+	}
+	return t, err
+}
+
+// apply works out the total due and the tax in it for a price after discounts.
+// Exclusive tax is added to the price; inclusive tax is the part of the price
+// that is tax. Tax is rounded to the minor unit once, on the whole amount.
+func (t TaxRate) apply(price Money) (total, tax Money) {
+	if t.PricingMode == taxInclusive {
+		return price, price.Sub(price.excludingPercent(t.Rate))
+	}
+	tax = price.Percent(t.Rate)
+	return price.Add(tax), tax
+}
+
+// description labels the tax on quotes and invoices, e.g. "GST 9%"
+func (t TaxRate) description() string {
+	name := t.Name
+	if name == "" {
+		name = "Tax"
+	}
+	label := fmt.Sprintf("%s %s%%", name, strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", t.Rate), "0"), "."))
+	if t.PricingMode == taxInclusive {
+		label += " (included in prices)"
+	}
+	return label
+}
+
+// setBillingPrice sets the amount due and tax of a billing from its price after discounts
+func setBillingPrice(billing *Billing, price Money, t TaxRate) {
+	billing.Amount, billing.TaxAmount = t.apply(price)
+	billing.TaxInclusive = t.PricingMode == taxInclusive
+}
+
+// preTaxAmount is the price of a billing after discounts and before exclusive tax
+func (b Billing) preTaxAmount() Money {
+	if b.TaxInclusive {
+		return b.Amount
+	}
+	return b.Amount.Sub(b.TaxAmount)
+}
+
+func getTaxRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rows, err := billingDB.Query("SELECT " + taxRateColumns + " FROM tax_rates ORDER BY jurisdiction")
+	if err != nil {
+		http.Error(w, "Failed to fetch tax rates", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []TaxRate{}
+	for rows.Next() {
+		t, err := scanTaxRate(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse tax rate data", http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, t)
+	}
+	json.NewEncoder(w).Encode(rates)
+}
+
+// Create or replace the tax rate of a jurisdiction. Billings already issued keep their tax.
+func putTaxRateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var t TaxRate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	// The jurisdiction is the key and comes from the URL
+	t.Jurisdiction = mux.Vars(r)["jurisdiction"]
+	if t.PricingMode == "" {
+		t.PricingMode = taxExclusive
+	}
+	switch {
+	case len(t.Jurisdiction) > 50:
+		http.Error(w, "Jurisdiction must be at most 50 characters", http.StatusBadRequest)
+		return
+	case strings.TrimSpace(t.Name) == "" || len(t.Name) > 50:
+		http.Error(w, "Tax name must be between 1 and 50 characters", http.StatusBadRequest)
+		return
+	case t.Rate < 0 || t.Rate >= 100:
+		http.Error(w, "Rate must be between 0 and 100", http.StatusBadRequest)
+		return
+	case t.PricingMode != taxExclusive && t.PricingMode != taxInclusive:
+		http.Error(w, "Pricing mode must be exclusive or inclusive", http.StatusBadRequest)
+		return
+	}
+
+	_, err := billingDB.Exec(`
+		INSERT INTO tax_rates (`+taxRateColumns+`) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE tax_name = VALUES(tax_name), rate = VALUES(rate), pricing_mode = VALUES(pricing_mode)`,
+		t.Jurisdiction, t.Name, t.Rate, t.PricingMode)
+	if err != nil {
+		http.Error(w, "Failed to save tax rate", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+func deleteTaxRateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	res, err := billingDB.Exec("DELETE FROM tax_rates WHERE jurisdiction = ?", mux.Vars(r)["jurisdiction"])
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Tax rate not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Tax rate deleted successfully"})
+}
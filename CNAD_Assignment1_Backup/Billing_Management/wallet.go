@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment methods, stored in payments.method
+const (
+	methodCard   = "card"
+	methodWallet = "wallet"
+)
+
+// Kinds of wallet transaction, stored in wallet_transactions.kind
+const (
+	walletTopUp   = "top_up"  // paid in by card
+	walletPayment = "payment" // spent on a billing
+	walletRefund  = "refund"  // a refund of a billing paid from the wallet
+	walletCredit  = "credit"  // goodwill credit issued by staff
+)
+
+var errInsufficientFunds = errors.New("wallet balance is too low")
+
+// walletAccount names a user's wallet in the ledger. Its ledger balance is the
+// negative of the wallet balance, since the money is owed to the user.
+func walletAccount(userID int) string {
+	return fmt.Sprintf("wallet:%d", userID)
+}
+
+// WalletTransaction is one change to a wallet balance
+type WalletTransaction struct {
+	ID        int    `json:"id"`
+	Kind      string `json:"kind"`
+	Amount    Money  `json:"amount"` // positive when money is added to the wallet
+	BillingID *int   `json:"billing_id,omitempty"`
+	TopUpID   *int   `json:"top_up_id,omitempty"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const walletTransactionColumns = "id, kind, currency, amount, COALESCE(billing_id, 0), COALESCE(top_up_id, 0), COALESCE(note, ''), created_at"
+
+func scanWalletTransaction(row interface{ Scan(...interface{}) error }) (WalletTransaction, error) {
+	var t WalletTransaction
+	var currency string
+	var amount moneyColumn
+	var billingID, topUpID int
+	err := row.Scan(&t.ID, &t.Kind, &currency, &amount, &billingID, &topUpID, &t.Note, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	if billingID != 0 {
+		t.BillingID = &billingID
+	}
+	if topUpID != 0 {
+		t.TopUpID = &topUpID
+	}
+	t.Amount, err = amount.money(currency)
+	return t, err
+}
+
+// TopUp is one attempt to add money to a wallet by card
+type TopUp struct {
+	ID            int    `json:"id"`
+	UserID        int    `json:"user_id"`
+	Amount        Money  `json:"amount"`
+	Status        string `json:"status"`
+	Reference     string `json:"gateway_reference"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	CardLast4     string `json:"card_last4"`
+	RedirectURL   string `json:"redirect_url,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	CompletedAt   string `json:"completed_at,omitempty"`
+}
+
+const topUpColumns = "id, user_id, currency, amount, status, gateway_reference, COALESCE(failure_reason, ''), card_last4, created_at, COALESCE(completed_at, '')"
+
+func scanTopUp(row interface{ Scan(...interface{}) error }) (TopUp, error) {
+	var t TopUp
+	var currency string
+	var amount moneyColumn
+	err := row.Scan(&t.ID, &t.UserID, &currency, &amount, &t.Status, &t.Reference, &t.FailureReason, &t.CardLast4, &t.CreatedAt, &t.CompletedAt)
+	if err != nil {
+		return t, err
+	}
+	t.Amount, err = amount.money(currency)
+	return t, err
+}
+
+// adjustWallet adds amount (negative to spend) to a user's wallet inside tx and
+// records the transaction, locking the balance until tx ends. Spending more
+// than the balance fails with errInsufficientFunds. The caller posts the
+// matching ledger entry.
+func adjustWallet(tx *sql.Tx, userID int, amount Money, kind string, billingID, topUpID int, note string, createdBy int) (int, error) {
+	_, err := tx.Exec("INSERT INTO wallets (user_id, currency, balance) VALUES (?, ?, 0) ON DUPLICATE KEY UPDATE balance = balance",
+		userID, amount.Currency)
+	if err != nil {
+		return 0, err
+	}
+	var current moneyColumn
+	err = tx.QueryRow("SELECT balance FROM wallets WHERE user_id = ? AND currency = ? FOR UPDATE", userID, amount.Currency).Scan(&current)
+	if err != nil {
+		return 0, err
+	}
+	balance, err := current.money(amount.Currency)
+	if err != nil {
+		return 0, err
+	}
+	balance = balance.Add(amount)
+	if balance.Minor < 0 {
+		return 0, errInsufficientFunds
+	}
+
+	if _, err := tx.Exec("UPDATE wallets SET balance = ? WHERE user_id = ? AND currency = ?", balance, userID, amount.Currency); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO wallet_transactions (user_id, currency, amount, kind, billing_id, top_up_id, note, created_by)
+		VALUES (?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, 0))`,
+		userID, amount.Currency, amount, kind, billingID, topUpID, note, createdBy)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+// walletReference is the payment or refund reference of a wallet transaction
+func walletReference(transactionID int) string {
+	return fmt.Sprintf("wallet_%d", transactionID)
+}
+
+// payFromWallet settles a billing locked by lockUnpaidBilling from the
+// customer's wallet. The wallet must hold the full amount in the billing's currency.
+func payFromWallet(tx *sql.Tx, billing Billing) (int64, error) {
+	transactionID, err := adjustWallet(tx, billing.UserID, billing.Amount.Neg(), walletPayment, billing.ID, 0, "", 0)
+	if err != nil {
+		return 0, err
+	}
+	reference := walletReference(transactionID)
+	res, err := tx.Exec(`
+		INSERT INTO payments (billing_id, method, currency, amount, status, gateway_reference, card_last4, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, '', NOW())`,
+		billing.ID, methodWallet, billing.Amount.Currency, billing.Amount, paymentSucceeded, reference)
+	if err != nil {
+		return 0, err
+	}
+	if err := markBillingPaid(tx, billing, walletAccount(billing.UserID), reference); err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// completeTopUp credits the wallet for a top-up the gateway accepted
+func completeTopUp(tx *sql.Tx, topUp TopUp) error {
+	if _, err := adjustWallet(tx, topUp.UserID, topUp.Amount, walletTopUp, 0, topUp.ID, "", 0); err != nil {
+		return err
+	}
+	return postLedgerEntry(tx, topUp.UserID, 0, ledgerTopUp, "Wallet top-up "+topUp.Reference,
+		LedgerLine{accountCash, topUp.Amount},
+		LedgerLine{walletAccount(topUp.UserID), topUp.Amount.Neg()})
+}
+
+// walletUserID parses the user of a wallet URL and checks the caller may use it
+func walletUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return userID, authorizeUserAccess(w, r, userID)
+}
+
+// walletAmount validates an amount sent for a top-up or credit. Bare amounts
+// are in the default currency.
+func walletAmount(w http.ResponseWriter, amount Money) (Money, bool) {
+	if amount.Currency == "" {
+		amount, _ = amount.inCurrency(defaultCurrency)
+	}
+	if !isCurrencyCode(amount.Currency) || !amount.IsPositive() {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return Money{}, false
+	}
+	return amount, true
+}
+
+// Show a user's wallet balance in each currency and its history, newest first
+func getWalletHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := walletUserID(w, r)
+	if !ok {
+		return
+	}
+
+	balances, err := sumByCurrency("SELECT currency, balance FROM wallets WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch wallet", http.StatusInternalServerError)
+		return
+	}
+	wallet := struct {
+		UserID       int                 `json:"user_id"`
+		Balances     []Money             `json:"balances"`
+		Transactions []WalletTransaction `json:"transactions"`
+	}{UserID: userID, Balances: []Money{}, Transactions: []WalletTransaction{}}
+	for _, balance := range balances {
+		wallet.Balances = append(wallet.Balances, balance)
+	}
+	sort.Slice(wallet.Balances, func(i, j int) bool { return wallet.Balances[i].Currency < wallet.Balances[j].Currency })
+
+	rows, err := billingDB.Query("SELECT "+walletTransactionColumns+" FROM wallet_transactions WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch wallet history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanWalletTransaction(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse wallet history", http.StatusInternalServerError)
+			return
+		}
+		wallet.Transactions = append(wallet.Transactions, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wallet)
+}
+
+// Add money to a wallet by card. Like card payments, a top-up may need a 3-D
+// Secure challenge, completed through confirmTopUpHandler.
+func createTopUpHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := walletUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount      Money  `json:"amount"`
+		CardNumber  string `json:"card_number"`
+		ExpiryMonth int    `json:"expiry_month"`
+		ExpiryYear  int    `json:"expiry_year"`
+		CVC         string `json:"cvc"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || len(input.CardNumber) < 4 {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	amount, ok := walletAmount(w, input.Amount)
+	if !ok {
+		return
+	}
+
+	result, err := paymentGateway.Charge(ChargeRequest{
+		Amount:      amount,
+		CardNumber:  input.CardNumber,
+		ExpiryMonth: input.ExpiryMonth,
+		ExpiryYear:  input.ExpiryYear,
+		CVC:         input.CVC,
+	})
+	if err != nil {
+		log.Printf("Payment gateway error for top-up of user %d: %v", userID, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	completed := result.Status != paymentRequiresAction
+	res, err := tx.Exec(`
+		INSERT INTO wallet_top_ups (user_id, currency, amount, status, gateway_reference, failure_reason, card_last4, completed_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, IF(?, NOW(), NULL))`,
+		userID, amount.Currency, amount, result.Status, result.Reference, result.FailureReason, input.CardNumber[len(input.CardNumber)-4:], completed)
+	if err != nil {
+		log.Printf("Failed to record top-up %s of user %d: %v", result.Reference, userID, err)
+		http.Error(w, "Failed to record top-up", http.StatusInternalServerError)
+		return
+	}
+	topUpID, _ := res.LastInsertId()
+
+	topUp, err := scanTopUp(tx.QueryRow("SELECT "+topUpColumns+" FROM wallet_top_ups WHERE id = ?", topUpID))
+	if err != nil {
+		http.Error(w, "Failed to fetch top-up", http.StatusInternalServerError)
+		return
+	}
+	if topUp.Status == paymentSucceeded {
+		if err := completeTopUp(tx, topUp); err != nil {
+			log.Printf("Failed to credit top-up %d: %v", topUp.ID, err)
+			http.Error(w, "Failed to credit wallet", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record top-up", http.StatusInternalServerError)
+		return
+	}
+	topUp.RedirectURL = result.RedirectURL
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(topUp.Status))
+	json.NewEncoder(w).Encode(topUp)
+}
+
+// Complete a top-up that is waiting on a 3-D Secure challenge
+func confirmTopUpHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := walletUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		ChallengeCode string `json:"challenge_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	topUp, err := scanTopUp(tx.QueryRow("SELECT "+topUpColumns+" FROM wallet_top_ups WHERE id = ? AND user_id = ? FOR UPDATE", mux.Vars(r)["top_up_id"], userID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Top-up not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch top-up", http.StatusInternalServerError)
+		return
+	}
+	if topUp.Status != paymentRequiresAction {
+		http.Error(w, "Top-up is not awaiting confirmation", http.StatusConflict)
+		return
+	}
+
+	result, err := paymentGateway.Confirm(topUp.Reference, input.ChallengeCode)
+	if err != nil {
+		log.Printf("Payment gateway error for top-up %d: %v", topUp.ID, err)
+		http.Error(w, "Payment gateway unavailable", http.StatusBadGateway)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE wallet_top_ups SET status = ?, failure_reason = NULLIF(?, ''), completed_at = NOW() WHERE id = ?",
+		result.Status, result.FailureReason, topUp.ID)
+	if err != nil {
+		http.Error(w, "Failed to record top-up", http.StatusInternalServerError)
+		return
+	}
+	if result.Status == paymentSucceeded {
+		if err := completeTopUp(tx, topUp); err != nil {
+			log.Printf("Failed to credit top-up %d: %v", topUp.ID, err)
+			http.Error(w, "Failed to credit wallet", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record top-up", http.StatusInternalServerError)
+		return
+	}
+
+	topUp, err = scanTopUp(billingDB.QueryRow("SELECT "+topUpColumns+" FROM wallet_top_ups WHERE id = ?", topUp.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch top-up", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(paymentResponseStatus(topUp.Status))
+	json.NewEncoder(w).Encode(topUp)
+}
+
+// Give a user goodwill credit, e.g. to make up for a service issue. Support
+// and billing admins only.
+func createWalletCreditHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := walletUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount Money  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	amount, ok := walletAmount(w, input.Amount)
+	if !ok {
+		return
+	}
+	if input.Note == "" || len(input.Note) > 255 {
+		http.Error(w, "Note must be between 1 and 255 characters", http.StatusBadRequest)
+		return
+	}
+	createdBy := 0
+	if claims, ok := claimsFromContext(r.Context()); ok {
+		createdBy = claims.UserID
+	}
+
+	tx, err := billingDB.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transactionID, err := adjustWallet(tx, userID, amount, walletCredit, 0, 0, input.Note, createdBy)
+	if err != nil {
+		http.Error(w, "Failed to credit wallet", http.StatusInternalServerError)
+		return
+	}
+	err = postLedgerEntry(tx, userID, 0, ledgerCredit, "Goodwill credit: "+input.Note,
+		LedgerLine{accountGoodwill, amount},
+		LedgerLine{walletAccount(userID), amount.Neg()})
+	if err != nil {
+		log.Printf("Failed to post goodwill credit for user %d: %v", userID, err)
+		http.Error(w, "Failed to credit wallet", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to credit wallet", http.StatusInternalServerError)
+		return
+	}
+
+	transaction, err := scanWalletTransaction(billingDB.QueryRow("SELECT "+walletTransactionColumns+" FROM wallet_transactions WHERE id = ?", transactionID))
+	if err != nil {
+		http.Error(w, "Failed to fetch wallet transaction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(transaction)
+}
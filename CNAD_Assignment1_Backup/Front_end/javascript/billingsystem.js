@@ -1,4 +1,8 @@
 const baseURL = "http://localhost:5002"; // Replace with your backend URL if different
+const authHeaders = { "Authorization": `Bearer ${sessionStorage.getItem("accessToken")}` };
+
+// Amounts arrive as { amount: "12.34", currency: "SGD" }
+const formatMoney = money => `${money.currency} ${money.amount}`;
 
 // Fetch billing info when the user enters a billing ID
 document.getElementById("fetchBillingBtn").addEventListener("click", () => {
@@ -9,11 +13,11 @@ document.getElementById("fetchBillingBtn").addEventListener("click", () => {
         return;
     }
 
-    fetch(`${baseURL}/billings/${billingId}`)
+    fetch(`${baseURL}/billings/${billingId}`, { headers: authHeaders })
         .then(response => response.json())
         .then(data => {
             document.getElementById("billingIdDetails").textContent = data.id;
-            document.getElementById("amountDetails").textContent = data.amount.toFixed(2);
+            document.getElementById("amountDetails").textContent = formatMoney(data.amount);
             document.getElementById("paymentStatusDetails").textContent = data.payment_status;
         })
         .catch(error => {
@@ -32,13 +36,13 @@ document.getElementById("generateInvoiceBtn").addEventListener("click", () => {
         return;
     }
 
-    fetch(`${baseURL}/invoices/${billingId}`)
+    fetch(`${baseURL}/invoices/${billingId}`, { headers: authHeaders })
         .then(response => response.json())
         .then(data => {
             document.getElementById("vehicleTypeDetails").textContent = data.vehicle_type;
             document.getElementById("membershipLevelDetails").textContent = data.membership_level;
-            document.getElementById("totalCostDetails").textContent = data.amount.toFixed(2);
-            document.getElementById("invoiceMessage").textContent = `Invoice generated. Total Cost: $${data.amount.toFixed(2)}`;
+            document.getElementById("totalCostDetails").textContent = formatMoney(data.amount);
+            document.getElementById("invoiceMessage").textContent = `Invoice ${data.invoice_number} generated. Total Cost: ${formatMoney(data.amount)}`;
         })
         .catch(error => {
             console.error("Error generating invoice:", error);
@@ -54,10 +58,10 @@ document.getElementById("generateReceiptBtn").addEventListener("click", () => {
         return;
     }
 
-    fetch(`${baseURL}/receipts/${billingId}`)
+    fetch(`${baseURL}/receipts/${billingId}`, { headers: authHeaders })
         .then(response => response.json())
         .then(data => {
-            document.getElementById("receiptMessage").textContent = `Receipt generated. Amount: $${data.amount.toFixed(2)}. Date: ${new Date(data.payment_date).toLocaleDateString()}`;
+            document.getElementById("receiptMessage").textContent = `Receipt generated. Amount: ${formatMoney(data.amount)}. Date: ${new Date(data.payment_date).toLocaleDateString()}`;
         })
         .catch(error => {
             console.error("Error generating receipt:", error);
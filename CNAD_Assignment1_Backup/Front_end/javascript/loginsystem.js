@@ -23,6 +23,8 @@ document.getElementById("loginForm").addEventListener("submit", (e) => {
                 throw new Error("Invalid user ID");
             }
             sessionStorage.setItem("userId", data.id);
+            sessionStorage.setItem("accessToken", data.access_token);
+            sessionStorage.setItem("refreshToken", data.refresh_token);
             window.location.href = "profile.html";
         })
         .catch((error) => {
@@ -10,7 +10,9 @@ document.addEventListener("DOMContentLoaded", () => {
         return;
     }
 
-    fetch(`http://localhost:5001/api/v1/users/${userId}`)
+    fetch(`http://localhost:5001/api/v1/users/${userId}`, {
+        headers: { "Authorization": `Bearer ${sessionStorage.getItem("accessToken")}` },
+    })
         .then((response) => {
             if (!response.ok) {
                 throw new Error("User not found");
@@ -42,7 +44,10 @@ document.getElementById("updateProfileForm").addEventListener("submit", (e) => {
 
     fetch(`http://localhost:5001/api/v1/users/${userId}`, {
         method: "PUT",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+            "Content-Type": "application/json",
+            "Authorization": `Bearer ${sessionStorage.getItem("accessToken")}`,
+        },
         body: JSON.stringify(updatedDetails),
     })
         .then((response) => {
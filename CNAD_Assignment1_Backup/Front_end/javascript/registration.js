@@ -1,4 +1,5 @@
 const baseURL = "http://localhost:5001/api/v1/users";
+const authHeader = `Bearer ${sessionStorage.getItem("accessToken")}`;
 
 // Handle Registration Form Submission
 document.getElementById("registerForm").addEventListener("submit", (e) => {
@@ -28,7 +29,7 @@ document.getElementById("registerForm").addEventListener("submit", (e) => {
 
 // Handle Get All Users
 document.getElementById("getAllUsers").addEventListener("click", () => {
-  fetch(baseURL)
+  fetch(baseURL, { headers: { "Authorization": authHeader } })
     .then((response) => response.json())
     .then((data) => {
       const usersList = document.getElementById("usersList");
@@ -54,7 +55,7 @@ document.getElementById("updateForm").addEventListener("submit", (e) => {
   
     fetch(`${baseURL}/${userId}`, {
       method: "PUT",
-      headers: { "Content-Type": "application/json" },
+      headers: { "Content-Type": "application/json", "Authorization": authHeader },
       body: JSON.stringify({
         name,
         email,
@@ -81,6 +82,7 @@ document.getElementById("deleteForm").addEventListener("submit", (e) => {
 
   fetch(`${baseURL}/${userId}`, {
     method: "DELETE",
+    headers: { "Authorization": authHeader },
   })
     .then((response) => {
       if (response.ok) {
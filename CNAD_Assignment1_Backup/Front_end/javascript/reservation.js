@@ -1,4 +1,5 @@
 const baseURL = "http://localhost:5000/reservations";
+const authHeader = `Bearer ${sessionStorage.getItem("accessToken")}`;
 
 // Fetch Available Vehicles
 document.getElementById("availabilityForm").addEventListener("submit", (e) => {
@@ -37,7 +38,7 @@ document.getElementById("reservationForm").addEventListener("submit", (e) => {
 
     fetch(`${baseURL}/reservations`, {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: { "Content-Type": "application/json", "Authorization": authHeader },
         body: JSON.stringify({ vehicle_id: vehicleId, user_id: userId, start_time: startTime, end_time: endTime }),
     })
         .then((response) => response.json())
@@ -60,7 +61,7 @@ document.getElementById("modifyReservationForm").addEventListener("submit", (e)
 
     fetch(`${baseURL}/reservations/${reservationId}`, {
         method: "PUT",
-        headers: { "Content-Type": "application/json" },
+        headers: { "Content-Type": "application/json", "Authorization": authHeader },
         body: JSON.stringify({ start_time: newStartTime, end_time: newEndTime }),
     })
         .then((response) => response.json())
@@ -81,6 +82,7 @@ document.getElementById("cancelReservationForm").addEventListener("submit", (e)
 
     fetch(`${baseURL}/reservations/${reservationId}`, {
         method: "DELETE",
+        headers: { "Authorization": authHeader },
     })
         .then((response) => {
             if (response.ok) {
@@ -3,6 +3,7 @@ const vehicleTable = document.getElementById("vehicleTable").getElementsByTagNam
 
 // Corrected API URL variable name
 const apiUrl = "http://localhost:5000/vehicles"; // Go server API URL
+const authHeader = `Bearer ${sessionStorage.getItem("accessToken")}`; // Vehicle changes require a fleet_admin login
 
 // Event listener for form submission
 vehicleForm.addEventListener("submit", function (event) {
@@ -10,14 +11,15 @@ vehicleForm.addEventListener("submit", function (event) {
     const vehicleId = document.getElementById("vehicleId").value;
     const make = document.getElementById("make").value;
     const model = document.getElementById("model").value;
+    const vehicleType = document.getElementById("vehicleType").value;
     const availability = document.getElementById("availability").checked;
 
     if (vehicleId) {
         // Update vehicle
-        updateVehicle(vehicleId, make, model, availability);
+        updateVehicle(vehicleId, make, model, vehicleType, availability);
     } else {
         // Create new vehicle
-        createVehicle(make, model, availability);
+        createVehicle(make, model, vehicleType, availability);
     }
 });
 
@@ -33,6 +35,7 @@ function fetchVehicles() {
                     <td>${vehicle.id}</td>
                     <td>${vehicle.make}</td>
                     <td>${vehicle.model}</td>
+                    <td>${vehicle.vehicle_type}</td>
                     <td>${vehicle.availability ? "Available" : "Not Available"}</td>
                     <td>
                         <button class="edit" onclick="editVehicle(${vehicle.id})">Edit</button>
@@ -45,12 +48,13 @@ function fetchVehicles() {
 }
 
 // Create a new vehicle
-function createVehicle(make, model, availability) {
-    const vehicle = { make, model, availability };
+function createVehicle(make, model, vehicleType, availability) {
+    const vehicle = { make, model, vehicle_type: vehicleType, availability };
     fetch(apiUrl, {
         method: "POST",
         headers: {
-            "Content-Type": "application/json"
+            "Content-Type": "application/json",
+            "Authorization": authHeader
         },
         body: JSON.stringify(vehicle)
     })
@@ -70,18 +74,20 @@ function editVehicle(id) {
             document.getElementById("vehicleId").value = vehicle.id;
             document.getElementById("make").value = vehicle.make;
             document.getElementById("model").value = vehicle.model;
+            document.getElementById("vehicleType").value = vehicle.vehicle_type;
             document.getElementById("availability").checked = vehicle.availability;
         })
         .catch(err => console.error("Error fetching vehicle for editing:", err));
 }
 
 // Update a vehicle
-function updateVehicle(id, make, model, availability) {
-    const vehicle = { make, model, availability };
+function updateVehicle(id, make, model, vehicleType, availability) {
+    const vehicle = { make, model, vehicle_type: vehicleType, availability };
     fetch(`${apiUrl}/${id}`, {
         method: "PUT",
         headers: {
-            "Content-Type": "application/json"
+            "Content-Type": "application/json",
+            "Authorization": authHeader
         },
         body: JSON.stringify(vehicle)
     })
@@ -95,7 +101,8 @@ function updateVehicle(id, make, model, availability) {
 // Delete a vehicle
 function deleteVehicle(id) {
     fetch(`${apiUrl}/${id}`, {
-        method: "DELETE"
+        method: "DELETE",
+        headers: { "Authorization": authHeader }
     })
     .then(() => fetchVehicles()) // Refresh the vehicle list
     .catch(err => console.error("Error deleting vehicle:", err));
@@ -0,0 +1,146 @@
+package main
+
+// auth.go is shared verbatim by User_Management, Vehicle_Management and
+// Billing_Management. Keep the copies in sync when changing it.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const tokenIssuer = "cnad-user-management"
+
+// Roles stored in users.role
+const (
+	roleCustomer     = "customer"
+	roleFleetAdmin   = "fleet_admin"
+	roleBillingAdmin = "billing_admin"
+	roleSupport      = "support"
+)
+
+// All services must be started with the same JWT_SECRET
+var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+
+// requireJWTSecret stops the service when JWT_SECRET is unset, rather than
+// signing and accepting tokens with a key anyone could guess
+func requireJWTSecret() {
+	if len(jwtSecret) == 0 {
+		log.Fatal("JWT_SECRET must be set")
+	}
+}
+
+// Claims carried by every access token issued from /api/v1/login
+type Claims struct {
+	UserID         int    `json:"user_id"`
+	MembershipTier string `json:"membership_tier"`
+	Role           string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt is getEnv for settings that must be a positive whole number. An
+// invalid value stops the service at startup instead of silently becoming 0.
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s must be a positive whole number, got %q", key, value)
+	}
+	return n
+}
+
+// parseAccessToken verifies the signature, issuer and expiry of an access token
+func parseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.UserID == 0 {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// authMiddleware rejects requests without a valid "Authorization: Bearer <token>"
+// header and stores the token claims on the request context
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		tokenString, found := strings.CutPrefix(header, "Bearer ")
+		if !found || tokenString == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing access token", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := parseAccessToken(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid or expired access token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAuth wraps a single handler for use with router.HandleFunc
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(next).ServeHTTP
+}
+
+// requireRole wraps a handler so that only callers holding one of the roles may use it
+func requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := claimsFromContext(r.Context())
+		if !claims.hasRole(roles...) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (c *Claims) hasRole(roles ...string) bool {
+	for _, role := range roles {
+		if c.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessUser reports whether the caller is the given user or holds one of the roles
+func (c *Claims) canAccessUser(userID int, roles ...string) bool {
+	return c.UserID == userID || c.hasRole(roles...)
+}
+
+// claimsFromContext returns the claims stored by authMiddleware
+func claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Currency of new users who do not choose one. Matches the Billing Service's default.
+var defaultCurrency = getEnv("BILLING_CURRENCY", "SGD")
+
+// isCurrencyCode reports whether s looks like an ISO 4217 code, e.g. "SGD"
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Change the currency a user is billed in. Bookings are billed in the default
+// currency instead when the vehicle has no rate in the preferred one.
+func updatePreferredCurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, id) {
+		return
+	}
+
+	var input struct {
+		PreferredCurrency string `json:"preferred_currency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	input.PreferredCurrency = strings.ToUpper(strings.TrimSpace(input.PreferredCurrency))
+	if !isCurrencyCode(input.PreferredCurrency) {
+		http.Error(w, "Invalid preferred currency", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM users WHERE id = ?", id).Scan(&exists); err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET preferred_currency = ? WHERE id = ?", input.PreferredCurrency, id); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"preferred_currency": input.PreferredCurrency})
+}
@@ -15,17 +15,21 @@ import (
 
 // User represents a user in the car-sharing system
 type User struct {
-	ID             string `json:"id"`
-	Name           string `json:"name"`
-	Email          string `json:"email"`
-	Password       string `json:"password"`
-	MembershipTier string `json:"membership_tier"`
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	Password          string `json:"password"`
+	MembershipTier    string `json:"membership_tier"`
+	Role              string `json:"role"`
+	PreferredCurrency string `json:"preferred_currency"` // ISO 4217 code the user is billed in where possible
 }
 
 type MembershipBenefits struct {
-	DiscountRate   float64 `json:"discount_rate"`   // Discount rate for hourly rentals
-	PriorityAccess bool    `json:"priority_access"` // Priority vehicle access
-	IncreasedLimit int     `json:"increased_limit"` // Increased booking limits
+	Tier           string  `json:"tier"`
+	DiscountRate   float64 `json:"discount_rate"`       // Discount rate for hourly rentals
+	PriorityAccess bool    `json:"priority_access"`     // Priority vehicle access
+	IncreasedLimit int     `json:"increased_limit"`     // Increased booking limits
+	BookingWindow  int     `json:"booking_window_days"` // How far ahead a priority tier may book
 }
 
 var db *sql.DB
@@ -46,7 +50,7 @@ func initDB() {
 func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	rows, err := db.Query("SELECT id, name, email, membership_tier FROM users")
+	rows, err := db.Query("SELECT id, name, email, membership_tier, role, preferred_currency FROM users")
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -56,7 +60,7 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier); err != nil {
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier, &user.Role, &user.PreferredCurrency); err != nil {
 			http.Error(w, "Error reading database", http.StatusInternalServerError)
 			return
 		}
@@ -68,10 +72,13 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	id := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, id) {
+		return
+	}
 
 	var user User
-	err := db.QueryRow("SELECT id, name, email, membership_tier FROM users WHERE id = ?", id).
-		Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier)
+	err := db.QueryRow("SELECT id, name, email, membership_tier, role, preferred_currency FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier, &user.Role, &user.PreferredCurrency)
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -90,9 +97,28 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if len(user.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	if user.PreferredCurrency == "" {
+		user.PreferredCurrency = defaultCurrency
+	}
+	if !isCurrencyCode(user.PreferredCurrency) {
+		http.Error(w, "Invalid preferred currency", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
 
-	_, err := db.Exec("INSERT INTO users (name, email, password, membership_tier) VALUES (?, ?, ?, ?)",
-		user.Name, user.Email, user.Password, user.MembershipTier)
+	// Self-registered accounts are always customers on the default tier; staff
+	// roles are granted by support and other tiers set by staff
+	_, err = db.Exec("INSERT INTO users (name, email, password, membership_tier, role, preferred_currency) VALUES (?, ?, ?, ?, ?, ?)",
+		user.Name, user.Email, hash, defaultMembershipTier, roleCustomer, user.PreferredCurrency)
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
@@ -103,6 +129,9 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	userId := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, userId) {
+		return
+	}
 
 	var user struct {
 		Name           string `json:"name"`
@@ -114,10 +143,14 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	tier, ok := requestedTier(w, r, user.MembershipTier)
+	if !ok {
+		return
+	}
 
 	_, err := db.Exec(
-		"UPDATE users SET name = ?, email = ?, membership_tier = ? WHERE id = ?",
-		user.Name, user.Email, user.MembershipTier, userId,
+		"UPDATE users SET name = ?, email = ?, membership_tier = COALESCE(NULLIF(?, ''), membership_tier) WHERE id = ?",
+		user.Name, user.Email, tier, userId,
 	)
 	if err != nil {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
@@ -158,12 +191,15 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user struct {
-		ID    int    `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
+		ID             int    `json:"id"`
+		Name           string `json:"name"`
+		Email          string `json:"email"`
+		MembershipTier string `json:"membership_tier"`
+		Role           string `json:"role"`
 	}
+	var storedPassword string
 
-	err := db.QueryRow("SELECT id, name, email FROM users WHERE email = ? AND password = ?", credentials.Email, credentials.Password).Scan(&user.ID, &user.Name, &user.Email)
+	err := db.QueryRow("SELECT id, name, email, membership_tier, role, password FROM users WHERE email = ?", credentials.Email).Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier, &user.Role, &storedPassword)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
@@ -172,11 +208,32 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ok, needsRehash := verifyPassword(storedPassword, credentials.Password)
+	if !ok {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	// Migrate legacy plaintext rows to a hash on their next successful login
+	if needsRehash {
+		rehashPassword(user.ID, credentials.Password)
+	}
+
+	tokens, err := issueTokenPair(db, user.ID, user.MembershipTier, user.Role)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"id":      user.ID,
-		"name":    user.Name,
-		"email":   user.Email,
-		"message": "Login successful",
+		"id":            user.ID,
+		"name":          user.Name,
+		"email":         user.Email,
+		"role":          user.Role,
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"token_type":    tokens.TokenType,
+		"expires_in":    tokens.ExpiresIn,
+		"message":       "Login successful",
 	})
 }
 
@@ -184,10 +241,13 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	id := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, id) {
+		return
+	}
 
 	var user User
-	err := db.QueryRow("SELECT id, name, email, membership_tier FROM users WHERE id = ?", id).
-		Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier)
+	err := db.QueryRow("SELECT id, name, email, membership_tier, role, preferred_currency FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Name, &user.Email, &user.MembershipTier, &user.Role, &user.PreferredCurrency)
 	if err == sql.ErrNoRows {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"message": "User not found"})
@@ -205,6 +265,9 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	id := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, id) {
+		return
+	}
 
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -213,21 +276,19 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input fields
-	if user.Name == "" || user.Email == "" || user.Password == "" || user.MembershipTier == "" {
+	if user.Name == "" || user.Email == "" || user.Password == "" {
 		http.Error(w, "All fields are required", http.StatusBadRequest)
 		return
 	}
-
-	validTiers := map[string]bool{"Basic": true, "Premium": true, "VIP": true}
-	if !validTiers[user.MembershipTier] {
-		http.Error(w, "Invalid membership tier", http.StatusBadRequest)
+	tier, ok := requestedTier(w, r, user.MembershipTier)
+	if !ok {
 		return
 	}
 
 	// Update user information in the database
 	res, err := db.Exec(
-		"UPDATE users SET name = ?, email = ?, membership_tier = ? WHERE id = ?",
-		user.Name, user.Email, user.MembershipTier, id,
+		"UPDATE users SET name = ?, email = ?, membership_tier = COALESCE(NULLIF(?, ''), membership_tier) WHERE id = ?",
+		user.Name, user.Email, tier, id,
 	)
 	if err != nil {
 		if strings.Contains(err.Error(), "Duplicate entry") {
@@ -250,9 +311,12 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		Email          string `json:"email"`
 		MembershipTier string `json:"membership_tier"`
 	}{
-		Name:           user.Name,
-		Email:          user.Email,
-		MembershipTier: user.MembershipTier,
+		Name:  user.Name,
+		Email: user.Email,
+	}
+	if err := db.QueryRow("SELECT membership_tier FROM users WHERE id = ?", id).Scan(&updatedUser.MembershipTier); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -260,22 +324,34 @@ func updateUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	requireJWTSecret()
 	initDB()
 	defer db.Close()
 
 	router := mux.NewRouter()
 
-	router.HandleFunc("/api/v1/users", getAllUsersHandler).Methods("GET")
-	router.HandleFunc("/api/v1/users/{id}", getUserHandler).Methods("GET")
+	router.HandleFunc("/api/v1/users", requireRole(getAllUsersHandler, roleSupport, roleBillingAdmin)).Methods("GET")
+	router.HandleFunc("/api/v1/users/{id}", requireAuth(getUserHandler)).Methods("GET")
 	router.HandleFunc("/api/v1/users", createUserHandler).Methods("POST")
-	router.HandleFunc("/api/v1/users/{id}", updateUserHandler).Methods("PUT")
-	router.HandleFunc("/api/v1/users/{id}", deleteUserHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{id}", requireAuth(updateUserHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{id}", requireRole(deleteUserHandler, roleSupport)).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{id}/password", requireAuth(changePasswordHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{id}/role", requireRole(updateUserRoleHandler, roleSupport)).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{id}/currency", requireAuth(updatePreferredCurrencyHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{id}/benefits", requireAuth(getUserBenefitsHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/memberships", getMembershipsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/memberships/{tier}", getMembershipHandler).Methods("GET")
+	router.HandleFunc("/api/v1/memberships", requireRole(createMembershipHandler, roleBillingAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/memberships/{tier}", requireRole(updateMembershipHandler, roleBillingAdmin)).Methods("PUT")
+	router.HandleFunc("/api/v1/memberships/{tier}", requireRole(deleteMembershipHandler, roleBillingAdmin)).Methods("DELETE")
 	router.HandleFunc("/api/v1/login", loginHandler).Methods("POST")
-	router.HandleFunc("/api/v1/users/{id}", getUserProfileHandler).Methods("GET")
-	router.HandleFunc("/api/v1/users/{id}", updateUserProfileHandler).Methods("PUT")
+	router.HandleFunc("/api/v1/token/refresh", refreshTokenHandler).Methods("POST")
+	router.HandleFunc("/api/v1/logout", logoutHandler).Methods("POST")
+	router.HandleFunc("/api/v1/users/{id}", requireAuth(getUserProfileHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/users/{id}", requireAuth(updateUserProfileHandler)).Methods("PUT")
 
 	corsHandler := handlers.CORS(
-		handlers.AllowedHeaders([]string{"Content-Type"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"}),
 		handlers.AllowedOrigins([]string{"*"}), // Replace "*" with the frontend origin if known
 	)
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const membershipColumns = "tier, discount_rate, increased_limit, priority_access, booking_window_days"
+
+func scanMembership(row interface{ Scan(...interface{}) error }) (MembershipBenefits, error) {
+	var b MembershipBenefits
+	err := row.Scan(&b.Tier, &b.DiscountRate, &b.IncreasedLimit, &b.PriorityAccess, &b.BookingWindow)
+	return b, err
+}
+
+// isValidTier reports whether a membership tier is defined in membership_benefits
+func isValidTier(tier string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM membership_benefits WHERE tier = ?", tier).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// validateMembership checks the fields an admin may set on a tier definition
+func validateMembership(b MembershipBenefits) string {
+	switch {
+	case strings.TrimSpace(b.Tier) == "" || len(b.Tier) > 50:
+		return "Tier name must be between 1 and 50 characters"
+	case b.DiscountRate < 0 || b.DiscountRate > 100:
+		return "Discount rate must be between 0 and 100"
+	case b.IncreasedLimit < 0:
+		return "Booking limit cannot be negative"
+	case b.BookingWindow < 0:
+		return "Booking window cannot be negative"
+	}
+	return ""
+}
+
+func getMembershipsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT " + membershipColumns + " FROM membership_benefits ORDER BY increased_limit")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	memberships := []MembershipBenefits{}
+	for rows.Next() {
+		b, err := scanMembership(rows)
+		if err != nil {
+			http.Error(w, "Error reading database", http.StatusInternalServerError)
+			return
+		}
+		memberships = append(memberships, b)
+	}
+	json.NewEncoder(w).Encode(memberships)
+}
+
+func getMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tier := mux.Vars(r)["tier"]
+
+	b, err := scanMembership(db.QueryRow("SELECT "+membershipColumns+" FROM membership_benefits WHERE tier = ?", tier))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Membership tier not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(b)
+}
+
+// Benefits of the tier the user is currently on
+func getUserBenefitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	if !authorizeUserAccess(w, r, id) {
+		return
+	}
+
+	b, err := scanMembership(db.QueryRow(`
+		SELECT b.tier, b.discount_rate, b.increased_limit, b.priority_access, b.booking_window_days
+		FROM users u
+		JOIN membership_benefits b ON b.tier = u.membership_tier
+		WHERE u.id = ?`, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(b)
+}
+
+func createMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var b MembershipBenefits
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if msg := validateMembership(b); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO membership_benefits ("+membershipColumns+") VALUES (?, ?, ?, ?, ?)",
+		b.Tier, b.DiscountRate, b.IncreasedLimit, b.PriorityAccess, b.BookingWindow)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			http.Error(w, "Membership tier already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+func updateMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tier := mux.Vars(r)["tier"]
+
+	var b MembershipBenefits
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	// The tier name is the key and comes from the URL
+	b.Tier = tier
+	if msg := validateMembership(b); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	exists, err := isValidTier(tier)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Membership tier not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec("UPDATE membership_benefits SET discount_rate = ?, increased_limit = ?, priority_access = ?, booking_window_days = ? WHERE tier = ?",
+		b.DiscountRate, b.IncreasedLimit, b.PriorityAccess, b.BookingWindow, tier)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(b)
+}
+
+func deleteMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tier := mux.Vars(r)["tier"]
+
+	var members int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE membership_tier = ?", tier).Scan(&members); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if members > 0 {
+		http.Error(w, "Membership tier is still assigned to users", http.StatusConflict)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM membership_benefits WHERE tier = ?", tier)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Membership tier not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Membership tier deleted successfully"})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// hashPassword returns the bcrypt hash stored in users.password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isHashedPassword reports whether a stored password is already a bcrypt hash.
+// Rows created before hashing was introduced still hold the plaintext value.
+func isHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks a login attempt against the stored password and
+// reports whether the stored value should be rehashed
+func verifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	if !isHashedPassword(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < bcrypt.DefaultCost
+}
+
+// rehashPassword replaces a legacy plaintext (or weak) password with a fresh hash.
+// Failures are logged and ignored so that a successful login is never rejected.
+func rehashPassword(userID int, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %d: %v", userID, err)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userID); err != nil {
+		log.Printf("Failed to store rehashed password for user %d: %v", userID, err)
+	}
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	if claims, ok := claimsFromContext(r.Context()); !ok || strconv.Itoa(claims.UserID) != id {
+		http.Error(w, "You can only change your own password", http.StatusForbidden)
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(input.NewPassword) < minPasswordLength {
+		http.Error(w, "New password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	var stored string
+	err := db.QueryRow("SELECT password FROM users WHERE id = ?", id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if ok, _ := verifyPassword(stored, input.CurrentPassword); !ok {
+		http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	hash, err := hashPassword(input.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, id); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// TokenPair is returned by the login and refresh endpoints
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func issueAccessToken(userID int, membershipTier, role string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		UserID:         userID,
+		MembershipTier: membershipTier,
+		Role:           role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+// hashToken is used so that refresh tokens are never stored in plaintext
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// issueTokenPair signs a new access token and stores a new refresh token
+func issueTokenPair(exec execer, userID int, membershipTier, role string) (TokenPair, error) {
+	accessToken, err := issueAccessToken(userID, membershipTier, role)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	_, err = exec.Exec("INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+		userID, hashToken(refreshToken), int(refreshTokenTTL.Seconds()))
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Exchange a refresh token for a new token pair. The old refresh token is
+// revoked; presenting an already revoked token revokes every session of that user.
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.RefreshToken == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var revoked, expired bool
+	err = tx.QueryRow("SELECT id, user_id, revoked, expires_at <= NOW() FROM refresh_tokens WHERE token_hash = ? FOR UPDATE",
+		hashToken(input.RefreshToken)).Scan(&tokenID, &userID, &revoked, &expired)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if revoked {
+		// A rotated token was replayed, so assume it was stolen
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ?", userID); err == nil {
+			tx.Commit()
+		}
+		http.Error(w, "Refresh token has been revoked", http.StatusUnauthorized)
+		return
+	}
+	if expired {
+		http.Error(w, "Refresh token has expired", http.StatusUnauthorized)
+		return
+	}
+
+	var membershipTier, role string
+	err = tx.QueryRow("SELECT membership_tier, role FROM users WHERE id = ?", userID).Scan(&membershipTier, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE id = ?", tokenID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := issueTokenPair(tx, userID, membershipTier, role)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Revoke a refresh token, or every refresh token of its user when all_sessions is set
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+		AllSessions  bool   `json:"all_sessions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.RefreshToken == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := hashToken(input.RefreshToken)
+	var res sql.Result
+	var err error
+	if input.AllSessions {
+		res, err = db.Exec(`
+			UPDATE refresh_tokens SET revoked = TRUE
+			WHERE user_id = (SELECT user_id FROM (SELECT user_id FROM refresh_tokens WHERE token_hash = ?) AS t)`, tokenHash)
+	} else {
+		res, err = db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE token_hash = ?", tokenHash)
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
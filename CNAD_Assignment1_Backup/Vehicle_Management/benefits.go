@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Days ahead that tiers without priority access may book
+var generalBookingWindowDays = getEnvInt("GENERAL_BOOKING_WINDOW_DAYS", 14)
+
+// MembershipBenefits mirrors a row of membership_benefits in user_management_db
+type MembershipBenefits struct {
+	Tier           string  `json:"tier"`
+	DiscountRate   float64 `json:"discount_rate"`
+	IncreasedLimit int     `json:"increased_limit"`
+	PriorityAccess bool    `json:"priority_access"`
+	BookingWindow  int     `json:"booking_window_days"`
+}
+
+// getUserBenefits loads the membership benefits of the user's current tier.
+// It returns sql.ErrNoRows when the user or their tier does not exist.
+func getUserBenefits(userID int) (MembershipBenefits, error) {
+	var b MembershipBenefits
+	err := userDB.QueryRow(`
+		SELECT b.tier, b.discount_rate, b.increased_limit, b.priority_access, b.booking_window_days
+		FROM users u
+		JOIN membership_benefits b ON b.tier = u.membership_tier
+		WHERE u.id = ?`, userID).Scan(&b.Tier, &b.DiscountRate, &b.IncreasedLimit, &b.PriorityAccess, &b.BookingWindow)
+	return b, err
+}
+
+// BookingLimitError is returned with a 409 when a user already holds as many
+// active reservations as their membership tier allows
+type BookingLimitError struct {
+	Error              string `json:"error"`
+	MembershipTier     string `json:"membership_tier"`
+	Limit              int    `json:"limit"`
+	ActiveReservations int    `json:"active_reservations"`
+}
+
+// bookingLimitError is returned when a user already holds as many active
+// reservations as their membership tier allows
+type bookingLimitError struct {
+	active int
+}
+
+func (e *bookingLimitError) Error() string {
+	return fmt.Sprintf("booking limit reached with %d active reservations", e.active)
+}
+
+// lockUserBookings takes a per-user lock for the rest of the transaction, so
+// concurrent bookings by the same user are counted one at a time. Users have
+// no row in this database; the lock is their row of user_booking_locks.
+func lockUserBookings(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec("INSERT INTO user_booking_locks (user_id) VALUES (?) ON DUPLICATE KEY UPDATE user_id = user_id", userID)
+	return err
+}
+
+// countActiveReservations counts the user's active and pending reservations
+// that have not ended yet. excludeID skips the reservation being rescheduled; pass 0 when
+// creating a new one.
+func countActiveReservations(q queryRower, userID, excludeID int) (int, error) {
+	var count int
+	err := q.QueryRow("SELECT COUNT(*) FROM reservations WHERE user_id = ? AND status IN ('pending', 'active') AND end_time > NOW() AND id <> ?", userID, excludeID).Scan(&count)
+	return count, err
+}
+
+// checkBookingLimit enforces the increased_limit of the user's tier. Run it
+// under lockUserBookings; it returns a bookingLimitError when no further
+// booking is allowed.
+func checkBookingLimit(q queryRower, benefits MembershipBenefits, userID, excludeID int) error {
+	count, err := countActiveReservations(q, userID, excludeID)
+	if err != nil {
+		return err
+	}
+	if count >= benefits.IncreasedLimit {
+		return &bookingLimitError{active: count}
+	}
+	return nil
+}
+
+// writeBookingLimitError sends the 409 for a bookingLimitError
+func writeBookingLimitError(w http.ResponseWriter, benefits MembershipBenefits, err *bookingLimitError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(BookingLimitError{
+		Error:              "Booking limit reached for membership tier",
+		MembershipTier:     benefits.Tier,
+		Limit:              benefits.IncreasedLimit,
+		ActiveReservations: err.active,
+	})
+}
+
+// BookingWindowError is returned with a 422 when a reservation starts further
+// ahead than the user's tier is allowed to book
+type BookingWindowError struct {
+	Error             string `json:"error"`
+	MembershipTier    string `json:"membership_tier"`
+	BookingWindowDays int    `json:"booking_window_days"`
+	LatestStartTime   string `json:"latest_start_time"`
+}
+
+// bookingWindowDays is how far ahead the tier may book. Priority tiers use
+// their own window; everyone else shares the general release window.
+func (b MembershipBenefits) bookingWindowDays() int {
+	if b.PriorityAccess && b.BookingWindow > generalBookingWindowDays {
+		return b.BookingWindow
+	}
+	return generalBookingWindowDays
+}
+
+// checkBookingWindow rejects reservations that start after the tier's booking
+// window closes. It writes the error response and returns false in that case.
+func checkBookingWindow(w http.ResponseWriter, benefits MembershipBenefits, startTime string) bool {
+	start, err := parseReservationTime(startTime)
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return false
+	}
+
+	days := benefits.bookingWindowDays()
+	latestStart := time.Now().AddDate(0, 0, days)
+	if !start.After(latestStart) {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(BookingWindowError{
+		Error:             "Start time is outside the booking window for membership tier",
+		MembershipTier:    benefits.Tier,
+		BookingWindowDays: days,
+		LatestStartTime:   latestStart.Format(reservationTimeLayouts[0]),
+	})
+	return false
+}
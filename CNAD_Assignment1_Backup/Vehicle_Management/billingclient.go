@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	billOnCreated   = "created"
+	billOnCompleted = "completed"
+)
+
+// Where Billing_Management is listening
+var billingServiceURL = getEnv("BILLING_SERVICE_URL", "http://localhost:5002")
+
+// When reservations are billed: when they are "completed" (default) or as soon as they are "created"
+var billingTrigger = getEnv("BILLING_TRIGGER", billOnCompleted)
+
+var billingClient = &http.Client{Timeout: 5 * time.Second}
+
+// billingServiceError is a response from Billing_Management other than success
+type billingServiceError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *billingServiceError) Error() string {
+	return fmt.Sprintf("billing service returned %d: %s", e.StatusCode, e.Message)
+}
+
+// postToBilling sends a reservation id to a Billing_Management endpoint,
+// forwarding the caller's access token, and decodes the JSON response into out
+func postToBilling(r *http.Request, path string, reservationID int, out interface{}) error {
+	return postJSONToBilling(r, path, map[string]int{"reservation_id": reservationID}, out)
+}
+
+// postJSONToBilling is postToBilling with any request body
+func postJSONToBilling(r *http.Request, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, billingServiceURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+	resp, err := billingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &billingServiceError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// requestBilling asks Billing_Management to bill a reservation and returns the billing id
+func requestBilling(r *http.Request, reservationID int) (int, error) {
+	var billing struct {
+		ID int `json:"id"`
+	}
+	if err := postToBilling(r, "/billings", reservationID, &billing); err != nil {
+		return 0, err
+	}
+	return billing.ID, nil
+}
+
+// BilledAmount is an amount of money as Billing_Management sends it, in
+// major units as a decimal string, e.g. {"amount": "12.34", "currency": "SGD"}
+type BilledAmount struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// CancellationSettlement is Billing_Management's outcome for a cancelled reservation
+type CancellationSettlement struct {
+	CancellationFee BilledAmount `json:"cancellation_fee"`
+	Refund          *struct {
+		Amount BilledAmount `json:"amount"`
+	} `json:"refund"`
+}
+
+// requestCancellationSettlement asks Billing_Management to apply the
+// cancellation policy to a cancelled reservation: it charges the fee and
+// refunds whatever was paid above it
+func requestCancellationSettlement(r *http.Request, reservationID int) (CancellationSettlement, error) {
+	var settlement CancellationSettlement
+	err := postToBilling(r, "/cancellations", reservationID, &settlement)
+	return settlement, err
+}
+
+// requestRescheduleSettlement asks Billing_Management to bring a rescheduled
+// reservation's unpaid billing and deposit hold in line with its new window
+func requestRescheduleSettlement(r *http.Request, reservationID int) error {
+	var out json.RawMessage
+	return postToBilling(r, "/reschedules", reservationID, &out)
+}
+
+// Overtime is Billing_Management's late return charge for a completed reservation
+type Overtime struct {
+	MinutesLate int          `json:"minutes_late"`
+	Charge      BilledAmount `json:"charge"` // before tax
+}
+
+// requestLateReturnCharge asks Billing_Management to charge for the time a
+// completed reservation was returned after its end time
+func requestLateReturnCharge(r *http.Request, reservationID int) (Overtime, error) {
+	var overtime Overtime
+	err := postToBilling(r, "/late-returns", reservationID, &overtime)
+	return overtime, err
+}
+
+// billReservation bills the reservation if event matches the configured
+// BILLING_TRIGGER and returns the billing id, or 0 if nothing was billed.
+// Failures are only logged: the reservation change has already been committed
+// and the billing can be requested again through POST /billings.
+func billReservation(r *http.Request, reservationID int, event string) int {
+	if billingTrigger != event {
+		return 0
+	}
+	billingID, err := requestBilling(r, reservationID)
+	if err != nil {
+		log.Printf("Failed to bill reservation %d: %v", reservationID, err)
+		return 0
+	}
+	return billingID
+}
+
+// DepositCard is the card a security deposit is held on
+type DepositCard struct {
+	CardNumber  string `json:"card_number"`
+	ExpiryMonth int    `json:"expiry_month"`
+	ExpiryYear  int    `json:"expiry_year"`
+	CVC         string `json:"cvc"`
+}
+
+// DepositHold is the state of a reservation's security deposit in Billing_Management
+type DepositHold struct {
+	ID             int          `json:"id"`
+	Status         string       `json:"status"` // requires_action, authorized, declined, captured or released
+	Amount         BilledAmount `json:"amount"`
+	CapturedAmount BilledAmount `json:"captured_amount"`
+	ReleaseAfter   string       `json:"release_after"`
+	RedirectURL    string       `json:"redirect_url,omitempty"` // where a 3-D Secure challenge is completed
+}
+
+// awaitingConfirmation reports whether the hold is waiting on a 3-D Secure
+// challenge. Such a hold does not hold the deposit yet.
+func (h *DepositHold) awaitingConfirmation() bool {
+	return h != nil && h.Status == "requires_action"
+}
+
+// requiresDeposit reports whether the vehicle's type has a security deposit
+// in vehicle_pricing
+func requiresDeposit(vehicleID int) (bool, error) {
+	var vehicleType string
+	err := vehicleDB.QueryRow("SELECT vehicle_type FROM vehicles WHERE id = ?", vehicleID).Scan(&vehicleType)
+	if err == sql.ErrNoRows {
+		return false, errVehicleNotFound
+	} else if err != nil {
+		return false, err
+	}
+	var count int
+	err = billingDB.QueryRow("SELECT COUNT(*) FROM vehicle_pricing WHERE vehicle_type = ? AND deposit > 0", vehicleType).Scan(&count)
+	return count > 0, err
+}
+
+// requestDepositHold asks Billing_Management to hold the deposit of a new
+// reservation on the card. A declined card is a billingServiceError with
+// status 402.
+func requestDepositHold(r *http.Request, reservationID int, card DepositCard) (DepositHold, error) {
+	var hold DepositHold
+	err := postJSONToBilling(r, "/deposits", struct {
+		ReservationID int `json:"reservation_id"`
+		DepositCard
+	}{reservationID, card}, &hold)
+	return hold, err
+}
+
+// requestDepositConfirmation passes the 3-D Secure challenge of a deposit
+// hold to Billing_Management. A declined challenge is a billingServiceError
+// with status 402, and an expired one has status 409.
+func requestDepositConfirmation(r *http.Request, holdID int, challengeCode string) (DepositHold, error) {
+	var hold DepositHold
+	err := postJSONToBilling(r, fmt.Sprintf("/deposits/%d/confirm", holdID), map[string]string{"challenge_code": challengeCode}, &hold)
+	return hold, err
+}
+
+// reservationDeposit reads the latest deposit hold of a reservation from the
+// billing database, or nil if it has none
+func reservationDeposit(reservationID int) (*DepositHold, error) {
+	var hold DepositHold
+	err := billingDB.QueryRow(`
+		SELECT id, status, currency, amount, currency, captured_amount, release_after
+		FROM deposit_holds WHERE reservation_id = ? ORDER BY id DESC LIMIT 1`, reservationID).
+		Scan(&hold.ID, &hold.Status, &hold.Amount.Currency, &hold.Amount.Amount, &hold.CapturedAmount.Currency, &hold.CapturedAmount.Amount, &hold.ReleaseAfter)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+// isDelinquent reports whether Billing_Management's dunning has marked the
+// user delinquent on a billing that is still unpaid
+func isDelinquent(userID int) (bool, error) {
+	var count int
+	err := billingDB.QueryRow(`
+		SELECT COUNT(*) FROM dunning_cases d JOIN billings b ON b.id = d.billing_id
+		WHERE d.user_id = ? AND d.delinquent AND b.payment_status = 'Pending'`, userID).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Minutes a customer has to pass the 3-D Secure challenge of a deposit hold.
+// Must match DEPOSIT_CHALLENGE_MINUTES of Billing_Management, which releases
+// holds still waiting after that.
+var depositChallengeMinutes = getEnvInt("DEPOSIT_CHALLENGE_MINUTES", 15)
+
+// How often pending reservations are looked for
+const pendingSweepInterval = time.Minute
+
+// activateReservation confirms a pending reservation once its deposit is held
+func activateReservation(reservationID int) error {
+	_, err := vehicleDB.Exec("UPDATE reservations SET status = 'active' WHERE id = ? AND status = 'pending'", reservationID)
+	return err
+}
+
+// removePendingReservation deletes a reservation whose deposit was never held.
+// Failures are only logged; sweepPendingReservations tries again later.
+func removePendingReservation(reservationID int) {
+	if _, err := vehicleDB.Exec("DELETE FROM reservations WHERE id = ? AND status = 'pending'", reservationID); err != nil {
+		log.Printf("Failed to remove reservation %d after its deposit hold failed: %v", reservationID, err)
+	}
+}
+
+// settlePendingReservation brings a pending reservation in line with its
+// deposit hold in the billing database: it is activated once the deposit is
+// held, kept while the challenge is outstanding, and removed otherwise. It
+// returns the reservation's status afterwards, or "" if it was removed.
+func settlePendingReservation(reservationID int) (string, *DepositHold, error) {
+	hold, err := reservationDeposit(reservationID)
+	if err != nil {
+		return "pending", nil, err
+	}
+	switch {
+	case hold != nil && hold.Status == "authorized":
+		return "active", hold, activateReservation(reservationID)
+	case hold.awaitingConfirmation():
+		return "pending", hold, nil
+	}
+	removePendingReservation(reservationID)
+	return "", hold, nil
+}
+
+// sweepPendingReservations settles every reservation that has been pending
+// for longer than the challenge window. By then Billing_Management has
+// released its hold, unless the challenge was passed.
+func sweepPendingReservations() {
+	rows, err := vehicleDB.Query("SELECT id FROM reservations WHERE status = 'pending' AND created_at <= NOW() - INTERVAL ? MINUTE", depositChallengeMinutes)
+	if err != nil {
+		log.Printf("Failed to look for pending reservations: %v", err)
+		return
+	}
+	var reservationIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Failed to read pending reservation: %v", err)
+			break
+		}
+		reservationIDs = append(reservationIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range reservationIDs {
+		status, _, err := settlePendingReservation(id)
+		if err != nil {
+			log.Printf("Failed to settle pending reservation %d: %v", id, err)
+			continue
+		}
+		switch status {
+		case "active":
+			log.Printf("Activated reservation %d; its deposit is held", id)
+		case "":
+			log.Printf("Removed reservation %d; its deposit was not confirmed in time", id)
+		}
+	}
+}
+
+// sweepPendingReservationsEvery runs sweepPendingReservations now and then at
+// every interval. It never returns.
+func sweepPendingReservationsEvery(interval time.Duration) {
+	for {
+		sweepPendingReservations()
+		time.Sleep(interval)
+	}
+}
+
+// Confirm a pending reservation by passing the 3-D Secure challenge of its
+// deposit hold. The reservation becomes active and is billed like a new one.
+// If the challenge fails or has expired, the reservation is removed.
+func confirmPendingReservationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeReservationAccess(w, r, id) {
+		return
+	}
+
+	var input struct {
+		ChallengeCode string `json:"challenge_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	reservationID, _ := strconv.Atoi(id)
+	var status string
+	if err := vehicleDB.QueryRow("SELECT status FROM reservations WHERE id = ?", reservationID).Scan(&status); err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	if status != "pending" {
+		http.Error(w, "Reservation is not waiting for a deposit confirmation", http.StatusConflict)
+		return
+	}
+	hold, err := reservationDeposit(reservationID)
+	if err != nil {
+		http.Error(w, "Failed to fetch deposit hold", http.StatusInternalServerError)
+		return
+	}
+	if hold == nil {
+		http.Error(w, "Reservation has no deposit hold to confirm", http.StatusConflict)
+		return
+	}
+	if hold.awaitingConfirmation() {
+		// The outcome is read back from the hold below, whatever the response
+		if _, err := requestDepositConfirmation(r, hold.ID, input.ChallengeCode); err != nil {
+			log.Printf("Deposit hold %d of reservation %d was not confirmed: %v", hold.ID, reservationID, err)
+		}
+	}
+
+	status, hold, err = settlePendingReservation(reservationID)
+	if err != nil {
+		log.Printf("Failed to settle pending reservation %d: %v", reservationID, err)
+		http.Error(w, "Failed to confirm reservation", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case status == "pending":
+		http.Error(w, "Failed to confirm deposit", http.StatusBadGateway)
+		return
+	case status == "" && hold != nil && hold.Status == "declined":
+		http.Error(w, "Deposit hold was declined", http.StatusPaymentRequired)
+		return
+	case status == "":
+		http.Error(w, "Deposit confirmation has expired", http.StatusConflict)
+		return
+	}
+
+	response := map[string]interface{}{
+		"reservation_id": reservationID,
+		"status":         status,
+		"deposit":        hold,
+	}
+	if billingID := billReservation(r, reservationID, billOnCreated); billingID != 0 {
+		response["billing_id"] = billingID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// Staff roles allowed to act on any customer's reservations
+var reservationStaffRoles = []string{roleFleetAdmin, roleSupport}
+
+// authorizeUserAccess checks that the caller is the given user or reservation staff.
+// It writes a 403 response and returns false otherwise.
+func authorizeUserAccess(w http.ResponseWriter, r *http.Request, userID int) bool {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok || !claims.canAccessUser(userID, reservationStaffRoles...) {
+		http.Error(w, "You do not have access to this user's reservations", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeReservationAccess looks up the owner of a reservation and checks the
+// caller may act on it. It writes the error response and returns false otherwise.
+func authorizeReservationAccess(w http.ResponseWriter, r *http.Request, reservationID string) bool {
+	var ownerID int
+	err := vehicleDB.QueryRow("SELECT user_id FROM reservations WHERE id = ?", reservationID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	return authorizeUserAccess(w, r, ownerID)
+}
+
+// authorizeUserQuery is authorizeUserAccess for a user id taken from the query string
+func authorizeUserQuery(w http.ResponseWriter, r *http.Request, userID string) bool {
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return false
+	}
+	return authorizeUserAccess(w, r, id)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+var (
+	errVehicleNotFound     = errors.New("vehicle not found")
+	errVehicleUnavailable  = errors.New("vehicle is not available")
+	errReservationOverlap  = errors.New("vehicle is not available for the requested time")
+	errReservationNotFound = errors.New("reservation not found")
+)
+
+// ReservationRequest is the body accepted by both reservation creation endpoints
+type ReservationRequest struct {
+	VehicleID int    `json:"vehicle_id"`
+	UserID    int    `json:"user_id"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	QuoteID   string `json:"quote_id"` // optional, from GET /quotes on Billing_Management
+	// Card the security deposit is held on; required for vehicle types with a deposit
+	DepositCard *DepositCard `json:"deposit_card"`
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// countOverlappingReservations counts active and pending reservations of the
+// vehicle whose interval intersects [startTime, endTime). excludeID skips the reservation
+// being rescheduled; pass 0 when creating a new one.
+func countOverlappingReservations(q queryRower, vehicleID int, startTime, endTime string, excludeID int) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM reservations
+              WHERE vehicle_id = ? AND status IN ('pending', 'active') AND id <> ?
+              AND (start_time < ? AND end_time > ?)`
+	err := q.QueryRow(query, vehicleID, excludeID, endTime, startTime).Scan(&count)
+	return count, err
+}
+
+// lockVehicle takes a row lock on the vehicle for the rest of the transaction,
+// so concurrent bookings of the same vehicle are checked one at a time
+func lockVehicle(tx *sql.Tx, vehicleID int) error {
+	var available bool
+	err := tx.QueryRow("SELECT availability FROM vehicles WHERE id = ? FOR UPDATE", vehicleID).Scan(&available)
+	if err == sql.ErrNoRows {
+		return errVehicleNotFound
+	} else if err != nil {
+		return err
+	}
+	if !available {
+		return errVehicleUnavailable
+	}
+	return nil
+}
+
+// insertReservation books the vehicle if the user is within their tier's
+// booking limit and no other reservation overlaps the requested window. The
+// checks and insert run in one transaction under the user's booking lock and
+// the vehicle row lock, taken in that order. status is "active", or "pending"
+// for a booking that is not confirmed until its deposit is held.
+func insertReservation(input ReservationRequest, benefits MembershipBenefits, status string) (int, error) {
+	tx, err := vehicleDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockUserBookings(tx, input.UserID); err != nil {
+		return 0, err
+	}
+	if err := lockVehicle(tx, input.VehicleID); err != nil {
+		return 0, err
+	}
+	if err := checkBookingLimit(tx, benefits, input.UserID, 0); err != nil {
+		return 0, err
+	}
+	count, err := countOverlappingReservations(tx, input.VehicleID, input.StartTime, input.EndTime, 0)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, errReservationOverlap
+	}
+
+	res, err := tx.Exec("INSERT INTO reservations (vehicle_id, user_id, start_time, end_time, status, quote_id) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))",
+		input.VehicleID, input.UserID, input.StartTime, input.EndTime, status, input.QuoteID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// rescheduleReservation moves an active reservation to a new window under the
+// same locking rules and booking limit as insertReservation
+func rescheduleReservation(reservationID int, startTime, endTime string, benefits MembershipBenefits) error {
+	tx, err := vehicleDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A locking read, so the counts below see bookings committed while waiting for the locks
+	var vehicleID, userID int
+	err = tx.QueryRow("SELECT vehicle_id, user_id FROM reservations WHERE id = ? AND status = 'active' FOR UPDATE", reservationID).Scan(&vehicleID, &userID)
+	if err == sql.ErrNoRows {
+		return errReservationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := lockUserBookings(tx, userID); err != nil {
+		return err
+	}
+	if err := lockVehicle(tx, vehicleID); err != nil {
+		return err
+	}
+	if err := checkBookingLimit(tx, benefits, userID, reservationID); err != nil {
+		return err
+	}
+	count, err := countOverlappingReservations(tx, vehicleID, startTime, endTime, reservationID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errReservationOverlap
+	}
+
+	// The quoted price no longer applies to the new window
+	if _, err := tx.Exec("UPDATE reservations SET start_time = ?, end_time = ?, quote_id = NULL WHERE id = ?", startTime, endTime, reservationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validateReservationWindow checks both times parse and the window is not empty
+func validateReservationWindow(w http.ResponseWriter, startTime, endTime string) bool {
+	start, err := parseReservationTime(startTime)
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return false
+	}
+	end, err := parseReservationTime(endTime)
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return false
+	}
+	if !end.After(start) {
+		http.Error(w, "End time must be after start time", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkQuote verifies that a quote sent with a booking is unexpired and was
+// issued for it, so billing can honour the quoted price
+func checkQuote(w http.ResponseWriter, input ReservationRequest) bool {
+	quote, err := parseQuoteToken(input.QuoteID, true)
+	if err != nil {
+		http.Error(w, "Quote is invalid or has expired", http.StatusUnprocessableEntity)
+		return false
+	}
+	start, _ := parseReservationTime(input.StartTime)
+	end, _ := parseReservationTime(input.EndTime)
+	if !quote.matches(input.VehicleID, input.UserID, start, end) {
+		http.Error(w, "Quote does not match the reservation", http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+// writeReservationError maps reservation errors to HTTP responses, using
+// fallback as the message for unexpected database errors
+func writeReservationError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+	case errors.Is(err, errReservationNotFound):
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+	case errors.Is(err, errVehicleUnavailable):
+		http.Error(w, "Vehicle is not available", http.StatusConflict)
+	case errors.Is(err, errReservationOverlap):
+		http.Error(w, "Vehicle is not available for the requested time", http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// reserveVehicle applies every booking rule, creates the reservation and holds
+// its security deposit, if any. It is the single creation path behind
+// /reservations and /create-reservation. It writes the error response and
+// returns false when nothing was booked. A reservation whose deposit hold
+// needs a 3-D Secure challenge stays pending, and is returned with the hold
+// awaiting confirmation; it is not active, and must not be billed, until
+// confirmPendingReservationHandler confirms it.
+func reserveVehicle(w http.ResponseWriter, r *http.Request, input ReservationRequest) (int, MembershipBenefits, *DepositHold, bool) {
+	if !authorizeUserAccess(w, r, input.UserID) {
+		return 0, MembershipBenefits{}, nil, false
+	}
+	if !validateReservationWindow(w, input.StartTime, input.EndTime) {
+		return 0, MembershipBenefits{}, nil, false
+	}
+	if input.QuoteID != "" && !checkQuote(w, input) {
+		return 0, MembershipBenefits{}, nil, false
+	}
+
+	// Bookings are only accepted for users on a defined membership tier
+	benefits, err := getUserBenefits(input.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User or membership tier not found", http.StatusNotFound)
+		return 0, benefits, nil, false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch membership benefits", http.StatusInternalServerError)
+		return 0, benefits, nil, false
+	}
+	if !checkBookingWindow(w, benefits, input.StartTime) {
+		return 0, benefits, nil, false
+	}
+
+	// Users with an overdue billing book again once it is paid
+	delinquent, err := isDelinquent(input.UserID)
+	if err != nil {
+		http.Error(w, "Failed to check outstanding billings", http.StatusInternalServerError)
+		return 0, benefits, nil, false
+	}
+	if delinquent {
+		http.Error(w, "Account has overdue billings; pay them to book again", http.StatusForbidden)
+		return 0, benefits, nil, false
+	}
+
+	depositRequired, err := requiresDeposit(input.VehicleID)
+	if err != nil {
+		writeReservationError(w, err, "Failed to check deposit")
+		return 0, benefits, nil, false
+	}
+	if depositRequired && (input.DepositCard == nil || len(input.DepositCard.CardNumber) < 4) {
+		http.Error(w, "This vehicle requires a deposit card", http.StatusBadRequest)
+		return 0, benefits, nil, false
+	}
+
+	status := "active"
+	if depositRequired {
+		status = "pending"
+	}
+	id, err := insertReservation(input, benefits, status)
+	var limitErr *bookingLimitError
+	if errors.As(err, &limitErr) {
+		writeBookingLimitError(w, benefits, limitErr)
+		return 0, benefits, nil, false
+	} else if err != nil {
+		writeReservationError(w, err, "Failed to create reservation")
+		return 0, benefits, nil, false
+	}
+	if !depositRequired {
+		return id, benefits, nil, true
+	}
+
+	// Without a deposit hold the booking does not stand
+	hold, err := requestDepositHold(r, id, *input.DepositCard)
+	if err != nil || (hold.Status != "authorized" && !hold.awaitingConfirmation()) {
+		log.Printf("Failed to hold deposit of reservation %d: %v", id, err)
+		removePendingReservation(id)
+		var billingErr *billingServiceError
+		if errors.As(err, &billingErr) && billingErr.StatusCode == http.StatusPaymentRequired {
+			http.Error(w, "Deposit hold was declined", http.StatusPaymentRequired)
+		} else {
+			http.Error(w, "Failed to hold deposit", http.StatusBadGateway)
+		}
+		return 0, benefits, nil, false
+	}
+	if hold.Status == "authorized" {
+		if err := activateReservation(id); err != nil {
+			// Left pending; sweepPendingReservations activates it
+			log.Printf("Failed to activate reservation %d: %v", id, err)
+		}
+	}
+	return id, benefits, &hold, true
+}
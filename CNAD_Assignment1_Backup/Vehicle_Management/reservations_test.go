@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tables reserveVehicle reads, with the columns it uses from tables.sql.
+// The user, vehicle and billing tables share the one test database.
+var testSchema = []string{
+	`CREATE TABLE users (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		membership_tier VARCHAR(50) NOT NULL
+	)`,
+	`CREATE TABLE membership_benefits (
+		tier VARCHAR(50) PRIMARY KEY,
+		discount_rate DECIMAL(5,2) NOT NULL,
+		increased_limit INT NOT NULL,
+		priority_access BOOLEAN NOT NULL,
+		booking_window_days INT NOT NULL DEFAULT 14
+	)`,
+	`CREATE TABLE vehicles (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		vehicle_type VARCHAR(50) NOT NULL DEFAULT 'sedan',
+		availability BOOLEAN
+	)`,
+	`CREATE TABLE reservations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		vehicle_id INT NOT NULL,
+		start_time DATETIME NOT NULL,
+		end_time DATETIME NOT NULL,
+		status ENUM('pending', 'active', 'cancelled', 'completed') DEFAULT 'active',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		quote_id TEXT
+	)`,
+	`CREATE TABLE user_booking_locks (
+		user_id INT PRIMARY KEY
+	)`,
+	`CREATE TABLE vehicle_pricing (
+		vehicle_type VARCHAR(50) NOT NULL,
+		deposit DECIMAL(10, 2) NOT NULL DEFAULT 0.00
+	)`,
+	`CREATE TABLE billings (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		payment_status VARCHAR(20) NOT NULL
+	)`,
+	`CREATE TABLE dunning_cases (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		billing_id INT NOT NULL,
+		user_id INT NOT NULL,
+		delinquent BOOLEAN NOT NULL DEFAULT FALSE
+	)`,
+}
+
+var testTables = []string{"users", "membership_benefits", "vehicles", "reservations", "user_booking_locks", "vehicle_pricing", "billings", "dunning_cases"}
+
+// openTestDB connects every database handle to the empty MySQL database named
+// by TEST_MYSQL_DSN, e.g. "user:password@tcp(127.0.0.1:3306)/vehicle_test",
+// and creates the test schema in it. Tests that need it are skipped without one.
+func openTestDB(t *testing.T) {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	dropTestTables := func() {
+		for _, table := range testTables {
+			db.Exec("DROP TABLE IF EXISTS " + table)
+		}
+	}
+	dropTestTables()
+	for _, stmt := range testSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Failed to create test schema: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		dropTestTables()
+		db.Close()
+	})
+
+	mustExec(t, db, "INSERT INTO membership_benefits (tier, discount_rate, increased_limit, priority_access, booking_window_days) VALUES ('Basic', 5.00, 2, FALSE, 14)")
+	vehicleDB, userDB, billingDB = db, db, db
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) sql.Result {
+	t.Helper()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+func insertID(t *testing.T, res sql.Result) int {
+	t.Helper()
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// reserveConcurrently runs reserveVehicle for every request at once, each as
+// its user, and returns the response status codes
+func reserveConcurrently(inputs []ReservationRequest) []int {
+	codes := make([]int, len(inputs))
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input ReservationRequest) {
+			defer wg.Done()
+			claims := &Claims{UserID: input.UserID, MembershipTier: "Basic", Role: roleCustomer}
+			r := httptest.NewRequest(http.MethodPost, "/reservations", nil)
+			r = r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+			w := httptest.NewRecorder()
+			if _, _, _, ok := reserveVehicle(w, r, input); ok {
+				codes[i] = http.StatusCreated
+			} else {
+				codes[i] = w.Code
+			}
+		}(i, input)
+	}
+	wg.Wait()
+	return codes
+}
+
+func countCodes(codes []int, code int) int {
+	n := 0
+	for _, c := range codes {
+		if c == code {
+			n++
+		}
+	}
+	return n
+}
+
+func testWindow() (string, string) {
+	start := time.Now().Add(24 * time.Hour)
+	return start.Format(reservationTimeLayouts[0]), start.Add(2 * time.Hour).Format(reservationTimeLayouts[0])
+}
+
+func TestReserveVehicleConcurrentSameWindow(t *testing.T) {
+	openTestDB(t)
+	vehicleID := insertID(t, mustExec(t, vehicleDB, "INSERT INTO vehicles (vehicle_type, availability) VALUES ('sedan', TRUE)"))
+
+	const bookings = 10
+	start, end := testWindow()
+	inputs := make([]ReservationRequest, bookings)
+	for i := range inputs {
+		// Separate users, so only the vehicle lock decides who gets it
+		userID := insertID(t, mustExec(t, userDB, "INSERT INTO users (membership_tier) VALUES ('Basic')"))
+		inputs[i] = ReservationRequest{VehicleID: vehicleID, UserID: userID, StartTime: start, EndTime: end}
+	}
+
+	codes := reserveConcurrently(inputs)
+	if n := countCodes(codes, http.StatusCreated); n != 1 {
+		t.Errorf("%d bookings succeeded, want 1 (codes %v)", n, codes)
+	}
+	if n := countCodes(codes, http.StatusConflict); n != bookings-1 {
+		t.Errorf("%d bookings were rejected with 409, want %d (codes %v)", n, bookings-1, codes)
+	}
+
+	var active int
+	if err := vehicleDB.QueryRow("SELECT COUNT(*) FROM reservations WHERE vehicle_id = ? AND status = 'active'", vehicleID).Scan(&active); err != nil {
+		t.Fatal(err)
+	}
+	if active != 1 {
+		t.Errorf("vehicle has %d active reservations, want 1", active)
+	}
+}
+
+func TestReserveVehicleConcurrentBookingLimit(t *testing.T) {
+	openTestDB(t)
+	userID := insertID(t, mustExec(t, userDB, "INSERT INTO users (membership_tier) VALUES ('Basic')"))
+
+	// Basic allows two active reservations
+	const bookings = 6
+	start, end := testWindow()
+	inputs := make([]ReservationRequest, bookings)
+	for i := range inputs {
+		vehicleID := insertID(t, mustExec(t, vehicleDB, "INSERT INTO vehicles (vehicle_type, availability) VALUES ('sedan', TRUE)"))
+		inputs[i] = ReservationRequest{VehicleID: vehicleID, UserID: userID, StartTime: start, EndTime: end}
+	}
+
+	codes := reserveConcurrently(inputs)
+	if n := countCodes(codes, http.StatusCreated); n != 2 {
+		t.Errorf("%d bookings succeeded, want 2 (codes %v)", n, codes)
+	}
+	if n := countCodes(codes, http.StatusConflict); n != bookings-2 {
+		t.Errorf("%d bookings were rejected with 409, want %d (codes %v)", n, bookings-2, codes)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,11 +18,19 @@ type Vehicle struct {
 	ID           int    `json:"id"`
 	Make         string `json:"make"`
 	Model        string `json:"model"`
+	VehicleType  string `json:"vehicle_type"`
+	Location     string `json:"location"` // tax jurisdiction the vehicle is rented in
 	Availability bool   `json:"availability"`
 }
 
+const vehicleColumns = "id, make, model, vehicle_type, location, availability"
+
+// Location given to vehicles created without one
+var defaultVehicleLocation = getEnv("DEFAULT_VEHICLE_LOCATION", "SG")
+
 var vehicleDB *sql.DB // Connection to the vehicles database
 var userDB *sql.DB    // Connection to the users database
+var billingDB *sql.DB // Connection to the billing database, for vehicle_pricing
 
 // Initialize the database connection
 func initDB() {
@@ -42,15 +51,65 @@ func initDB() {
 		log.Fatalf("Failed to ping user database: %v", err)
 	}
 
-	fmt.Println("Connected to the user and vehicle databases.")
+	billingDB, err = sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/billingpayment_db")
+	if err != nil {
+		log.Fatalf("Failed to connect to billing database: %v", err)
+	}
+	if err := billingDB.Ping(); err != nil {
+		log.Fatalf("Failed to ping billing database: %v", err)
+	}
+
+	fmt.Println("Connected to the user, vehicle and billing databases.")
 }
 
 // CRUD Handlers for Vehicles
 
-// Get all vehicles
+func scanVehicle(row interface{ Scan(...interface{}) error }) (Vehicle, error) {
+	var v Vehicle
+	err := row.Scan(&v.ID, &v.Make, &v.Model, &v.VehicleType, &v.Location, &v.Availability)
+	return v, err
+}
+
+// isPricedVehicleType reports whether vehicle_pricing has a rate for the type
+func isPricedVehicleType(vehicleType string) (bool, error) {
+	var count int
+	err := billingDB.QueryRow("SELECT COUNT(*) FROM vehicle_pricing WHERE vehicle_type = ?", vehicleType).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// validateVehicleType writes an error response and returns false unless the
+// vehicle's type can be priced by Billing_Management
+func validateVehicleType(w http.ResponseWriter, vehicleType string) bool {
+	if vehicleType == "" {
+		http.Error(w, "Vehicle type is required", http.StatusBadRequest)
+		return false
+	}
+	priced, err := isPricedVehicleType(vehicleType)
+	if err != nil {
+		http.Error(w, "Failed to check vehicle type", http.StatusInternalServerError)
+		return false
+	}
+	if !priced {
+		http.Error(w, "Unknown vehicle type", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Get all vehicles, optionally filtered with ?type=
 func getVehicles(w http.ResponseWriter, r *http.Request) {
 	vehicles := []Vehicle{}
-	rows, err := vehicleDB.Query("SELECT id, make, model, availability FROM vehicles")
+	query := "SELECT " + vehicleColumns + " FROM vehicles"
+	var args []interface{}
+	if vehicleType := r.URL.Query().Get("type"); vehicleType != "" {
+		query += " WHERE vehicle_type = ?"
+		args = append(args, vehicleType)
+	}
+
+	rows, err := vehicleDB.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch vehicles", http.StatusInternalServerError)
 		return
@@ -58,8 +117,8 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var v Vehicle
-		if err := rows.Scan(&v.ID, &v.Make, &v.Model, &v.Availability); err != nil {
+		v, err := scanVehicle(rows)
+		if err != nil {
 			http.Error(w, "Failed to parse vehicles", http.StatusInternalServerError)
 			return
 		}
@@ -74,10 +133,7 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
 func getVehicle(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	var v Vehicle
-	err := vehicleDB.QueryRow("SELECT id, make, model, availability FROM vehicles WHERE id = ?", id).Scan(
-		&v.ID, &v.Make, &v.Model, &v.Availability,
-	)
+	v, err := scanVehicle(vehicleDB.QueryRow("SELECT "+vehicleColumns+" FROM vehicles WHERE id = ?", id))
 	if err == sql.ErrNoRows {
 		http.Error(w, "Vehicle not found", http.StatusNotFound)
 		return
@@ -97,8 +153,14 @@ func createVehicle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if !validateVehicleType(w, v.VehicleType) {
+		return
+	}
+	if v.Location == "" {
+		v.Location = defaultVehicleLocation
+	}
 
-	res, err := vehicleDB.Exec("INSERT INTO vehicles (make, model, availability) VALUES (?, ?, ?)", v.Make, v.Model, v.Availability)
+	res, err := vehicleDB.Exec("INSERT INTO vehicles (make, model, vehicle_type, location, availability) VALUES (?, ?, ?, ?, ?)", v.Make, v.Model, v.VehicleType, v.Location, v.Availability)
 	if err != nil {
 		http.Error(w, "Failed to create vehicle", http.StatusInternalServerError)
 		return
@@ -119,8 +181,14 @@ func updateVehicle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if !validateVehicleType(w, v.VehicleType) {
+		return
+	}
+	if v.Location == "" {
+		v.Location = defaultVehicleLocation
+	}
 
-	res, err := vehicleDB.Exec("UPDATE vehicles SET make = ?, model = ?, availability = ? WHERE id = ?", v.Make, v.Model, v.Availability, id)
+	res, err := vehicleDB.Exec("UPDATE vehicles SET make = ?, model = ?, vehicle_type = ?, location = ?, availability = ? WHERE id = ?", v.Make, v.Model, v.VehicleType, v.Location, v.Availability, id)
 	if err != nil {
 		http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
 		return
@@ -168,7 +236,7 @@ func getAvailableVehiclesForUserHandler(w http.ResponseWriter, r *http.Request)
 
 	// Query to fetch available vehicles
 	rows, err := vehicleDB.Query(`
-        SELECT id, make, model, availability 
+        SELECT id, make, model, vehicle_type, location, availability 
         FROM vehicles 
         WHERE availability = TRUE
     `)
@@ -180,8 +248,8 @@ func getAvailableVehiclesForUserHandler(w http.ResponseWriter, r *http.Request)
 
 	var vehicles []Vehicle
 	for rows.Next() {
-		var vehicle Vehicle
-		if err := rows.Scan(&vehicle.ID, &vehicle.Make, &vehicle.Model, &vehicle.Availability); err != nil {
+		vehicle, err := scanVehicle(rows)
+		if err != nil {
 			http.Error(w, "Error scanning vehicle data", http.StatusInternalServerError)
 			return
 		}
@@ -195,7 +263,7 @@ func getAvailableVehiclesForUserHandler(w http.ResponseWriter, r *http.Request)
 func getAvailableVehiclesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	rows, err := vehicleDB.Query("SELECT id, make, model, availability FROM vehicles WHERE availability = TRUE")
+	rows, err := vehicleDB.Query("SELECT " + vehicleColumns + " FROM vehicles WHERE availability = TRUE")
 	if err != nil {
 		http.Error(w, "Failed to fetch available vehicles", http.StatusInternalServerError)
 		return
@@ -204,8 +272,8 @@ func getAvailableVehiclesHandler(w http.ResponseWriter, r *http.Request) {
 
 	var vehicles []Vehicle
 	for rows.Next() {
-		var vehicle Vehicle
-		if err := rows.Scan(&vehicle.ID, &vehicle.Make, &vehicle.Model, &vehicle.Availability); err != nil {
+		vehicle, err := scanVehicle(rows)
+		if err != nil {
 			http.Error(w, "Failed to parse vehicle data", http.StatusInternalServerError)
 			return
 		}
@@ -217,41 +285,39 @@ func getAvailableVehiclesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func createReservation(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		VehicleID int    `json:"vehicle_id"`
-		UserID    int    `json:"user_id"`
-		StartTime string `json:"start_time"`
-		EndTime   string `json:"end_time"`
-	}
-
+	var input ReservationRequest
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	// Ensure the vehicle is available for the requested time
-	query := `
-        SELECT COUNT(*) FROM reservations
-        WHERE vehicle_id = ? AND status = 'active'
-        AND ((start_time BETWEEN ? AND ?) OR (end_time BETWEEN ? AND ?))
-    `
-	var count int
-	err := vehicleDB.QueryRow(query, input.VehicleID, input.StartTime, input.EndTime, input.StartTime, input.EndTime).Scan(&count)
-	if err != nil || count > 0 {
-		http.Error(w, "Vehicle is not available for the requested time", http.StatusConflict)
+	id, benefits, deposit, ok := reserveVehicle(w, r, input)
+	if !ok {
 		return
 	}
 
-	res, err := vehicleDB.Exec("INSERT INTO reservations (vehicle_id, user_id, start_time, end_time) VALUES (?, ?, ?, ?)",
-		input.VehicleID, input.UserID, input.StartTime, input.EndTime)
-	if err != nil {
-		http.Error(w, "Failed to create reservation", http.StatusInternalServerError)
+	response := map[string]interface{}{
+		"reservation_id":  id,
+		"membership_tier": benefits.Tier,
+	}
+	if deposit != nil {
+		response["deposit"] = deposit
+	}
+	// Not booked until the deposit challenge is passed at
+	// /reservations/{id}/confirm-deposit, and billed then
+	if deposit.awaitingConfirmation() {
+		response["status"] = "pending"
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
 		return
 	}
+	response["status"] = "active"
+	if billingID := billReservation(r, id, billOnCreated); billingID != 0 {
+		response["billing_id"] = billingID
+	}
 
-	id, _ := res.LastInsertId()
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]int{"reservation_id": int(id)})
+	json.NewEncoder(w).Encode(response)
 }
 
 func checkIfUserExists(userID int) (bool, error) {
@@ -263,32 +329,15 @@ func checkIfUserExists(userID int) (bool, error) {
 	return count > 0, nil
 }
 
-func createReservations(vehicleID, userID int, startTime, endTime string) error {
-	// First, check if the user exists
-	userExists, err := checkIfUserExists(userID)
-	if err != nil {
-		return fmt.Errorf("error checking if user exists: %v", err)
-	}
-	if !userExists {
-		return fmt.Errorf("user with ID %d does not exist", userID)
-	}
-
-	// If user exists, proceed with creating the reservation
-	_, err = vehicleDB.Exec("INSERT INTO reservations (vehicle_id, user_id, start_time, end_time, status) VALUES (?, ?, ?, ?, 'active')", vehicleID, userID, startTime, endTime)
-	if err != nil {
-		return fmt.Errorf("failed to create reservation: %v", err)
-	}
-
-	fmt.Println("Reservation created successfully.")
-	return nil
-}
-
 func getReservationsByUserHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
 		http.Error(w, "User ID is required", http.StatusBadRequest)
 		return
 	}
+	if !authorizeUserQuery(w, r, userID) {
+		return
+	}
 
 	// Query to get reservations for the user
 	rows, err := vehicleDB.Query(`
@@ -307,11 +356,12 @@ func getReservationsByUserHandler(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	var reservations []struct {
-		ID        int    `json:"id"`
-		Vehicle   string `json:"vehicle"`
-		StartTime string `json:"start_time"`
-		EndTime   string `json:"end_time"`
-		Status    string `json:"status"`
+		ID        int          `json:"id"`
+		Vehicle   string       `json:"vehicle"`
+		StartTime string       `json:"start_time"`
+		EndTime   string       `json:"end_time"`
+		Status    string       `json:"status"`
+		Deposit   *DepositHold `json:"deposit,omitempty"`
 	}
 
 	for rows.Next() {
@@ -327,18 +377,25 @@ func getReservationsByUserHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Error scanning data", http.StatusInternalServerError)
 			return
 		}
+		deposit, err := reservationDeposit(reservation.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch deposit", http.StatusInternalServerError)
+			return
+		}
 		reservations = append(reservations, struct {
-			ID        int    `json:"id"`
-			Vehicle   string `json:"vehicle"`
-			StartTime string `json:"start_time"`
-			EndTime   string `json:"end_time"`
-			Status    string `json:"status"`
+			ID        int          `json:"id"`
+			Vehicle   string       `json:"vehicle"`
+			StartTime string       `json:"start_time"`
+			EndTime   string       `json:"end_time"`
+			Status    string       `json:"status"`
+			Deposit   *DepositHold `json:"deposit,omitempty"`
 		}{
 			ID:        reservation.ID,
 			Vehicle:   reservation.Make + " " + reservation.Model,
 			StartTime: reservation.StartTime,
 			EndTime:   reservation.EndTime,
 			Status:    reservation.Status,
+			Deposit:   deposit,
 		})
 	}
 
@@ -348,49 +405,22 @@ func getReservationsByUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func createReservationHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse input data
-	var input struct {
-		VehicleID int    `json:"vehicle_id"`
-		UserID    int    `json:"user_id"`
-		StartTime string `json:"start_time"`
-		EndTime   string `json:"end_time"`
-	}
+	var input ReservationRequest
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	// Check if user exists in the user database
-	var userCount int
-	err := userDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", input.UserID).Scan(&userCount)
-	if err != nil || userCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	// Check if the vehicle is available in the vehicle database
-	var vehicleAvailable bool
-	err = vehicleDB.QueryRow(`
-		SELECT availability 
-		FROM vehicles 
-		WHERE id = ?`, input.VehicleID).Scan(&vehicleAvailable)
-	if err != nil {
-		http.Error(w, "Error fetching vehicle availability", http.StatusInternalServerError)
+	id, _, deposit, ok := reserveVehicle(w, r, input)
+	if !ok {
 		return
 	}
-	if !vehicleAvailable {
-		http.Error(w, "Vehicle is not available", http.StatusConflict)
-		return
-	}
-
-	// Insert reservation into reservations table
-	_, err = vehicleDB.Exec(`
-		INSERT INTO reservations (vehicle_id, user_id, start_time, end_time, status)
-		VALUES (?, ?, ?, ?, 'active')`,
-		input.VehicleID, input.UserID, input.StartTime, input.EndTime)
-	if err != nil {
-		http.Error(w, "Failed to create reservation", http.StatusInternalServerError)
+	if deposit.awaitingConfirmation() {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Reservation pending until its deposit is confirmed"))
 		return
 	}
+	billReservation(r, id, billOnCreated)
 
 	// Respond with success
 	w.WriteHeader(http.StatusCreated)
@@ -399,6 +429,9 @@ func createReservationHandler(w http.ResponseWriter, r *http.Request) {
 
 func updateReservationHandler(w http.ResponseWriter, r *http.Request) {
 	reservationId := mux.Vars(r)["id"]
+	if !authorizeReservationAccess(w, r, reservationId) {
+		return
+	}
 
 	var reservation struct {
 		StartTime string `json:"start_time"`
@@ -410,20 +443,57 @@ func updateReservationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := vehicleDB.Exec("UPDATE reservations SET start_time = ?, end_time = ? WHERE id = ?", reservation.StartTime, reservation.EndTime, reservationId)
-	if err != nil {
-		http.Error(w, "Failed to update reservation", http.StatusInternalServerError)
+	if !validateReservationWindow(w, reservation.StartTime, reservation.EndTime) {
+		return
+	}
+
+	// The new window must fit the booking rules of the owner's tier
+	var ownerID int
+	if err := vehicleDB.QueryRow("SELECT user_id FROM reservations WHERE id = ?", reservationId).Scan(&ownerID); err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return
+	}
+	benefits, err := getUserBenefits(ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User or membership tier not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch membership benefits", http.StatusInternalServerError)
+		return
+	}
+	if !checkBookingWindow(w, benefits, reservation.StartTime) {
 		return
 	}
 
+	id, _ := strconv.Atoi(reservationId)
+	err = rescheduleReservation(id, reservation.StartTime, reservation.EndTime, benefits)
+	var limitErr *bookingLimitError
+	if errors.As(err, &limitErr) {
+		writeBookingLimitError(w, benefits, limitErr)
+		return
+	} else if err != nil {
+		writeReservationError(w, err, "Failed to update reservation")
+		return
+	}
+
+	// Billing_Management reprices an unpaid billing and moves the deposit
+	// release to the new end time. The reschedule stands even if that fails;
+	// it can be requested again through POST /reschedules.
+	if err := requestRescheduleSettlement(r, id); err != nil {
+		log.Printf("Failed to reprice rescheduled reservation %d: %v", id, err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Reservation updated successfully"})
 }
 
 func cancelReservation(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
+	if !authorizeReservationAccess(w, r, id) {
+		return
+	}
 
-	res, err := vehicleDB.Exec("UPDATE reservations SET status = 'cancelled' WHERE id = ?", id)
+	res, err := vehicleDB.Exec("UPDATE reservations SET status = 'cancelled', cancelled_at = NOW() WHERE id = ? AND status = 'active'", id)
 	if err != nil {
 		http.Error(w, "Failed to cancel reservation", http.StatusInternalServerError)
 		return
@@ -431,12 +501,74 @@ func cancelReservation(w http.ResponseWriter, r *http.Request) {
 
 	rowsAffected, _ := res.RowsAffected()
 	if rowsAffected == 0 {
-		http.Error(w, "Reservation not found", http.StatusNotFound)
+		http.Error(w, "Only active reservations can be cancelled", http.StatusConflict)
+		return
+	}
+
+	response := map[string]interface{}{"message": "Reservation cancelled successfully"}
+
+	// Billing_Management charges the cancellation fee and refunds the rest of
+	// any payment. The cancellation stands even if that fails, but the caller
+	// is told with a 502 so the settlement can be requested again through
+	// POST /cancellations.
+	reservationID, _ := strconv.Atoi(id)
+	settlement, err := requestCancellationSettlement(r, reservationID)
+	if err != nil {
+		log.Printf("Failed to settle cancellation of reservation %d: %v", reservationID, err)
+		response["message"] = "Reservation cancelled, but its cancellation fee and refund could not be settled"
+		response["settlement_error"] = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	response["cancellation_fee"] = settlement.CancellationFee
+	if settlement.Refund != nil {
+		response["refunded_amount"] = settlement.Refund.Amount
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Mark an active reservation as completed once the vehicle has been returned,
+// recording the return time
+func completeReservationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeReservationAccess(w, r, id) {
+		return
+	}
+
+	res, err := vehicleDB.Exec("UPDATE reservations SET status = 'completed', returned_at = NOW() WHERE id = ? AND status = 'active'", id)
+	if err != nil {
+		http.Error(w, "Failed to complete reservation", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Only active reservations can be completed", http.StatusConflict)
 		return
 	}
 
+	response := map[string]interface{}{"message": "Reservation completed successfully"}
+	reservationID, _ := strconv.Atoi(id)
+	if billingID := billReservation(r, reservationID, billOnCompleted); billingID != 0 {
+		response["billing_id"] = billingID
+	}
+
+	// Billing_Management adds any late return charge to the billing. The
+	// return stands even if that fails; the charge can be requested again
+	// through POST /late-returns.
+	overtime, err := requestLateReturnCharge(r, reservationID)
+	if err != nil {
+		log.Printf("Failed to charge late return of reservation %d: %v", reservationID, err)
+	} else if overtime.MinutesLate > 0 {
+		response["minutes_late"] = overtime.MinutesLate
+		response["overtime_charge"] = overtime.Charge
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Reservation cancelled successfully"})
+	json.NewEncoder(w).Encode(response)
 }
 
 func checkUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -489,11 +621,7 @@ func checkVehicleAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkVehicleAvailability(vehicleID int, startTime, endTime string) (bool, error) {
-	var count int
-	query := `SELECT COUNT(*) FROM reservations 
-              WHERE vehicle_id = ? AND status = 'active' 
-              AND (start_time < ? AND end_time > ?)`
-	err := vehicleDB.QueryRow(query, vehicleID, endTime, startTime).Scan(&count)
+	count, err := countOverlappingReservations(vehicleDB, vehicleID, startTime, endTime, 0)
 	if err != nil {
 		return false, err
 	}
@@ -504,7 +632,7 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -514,35 +642,42 @@ func enableCORS(next http.Handler) http.Handler {
 }
 
 func main() {
+	requireJWTSecret()
 	initDB()
 	defer vehicleDB.Close()
 	defer userDB.Close()
+	defer billingDB.Close()
+
+	go sweepPendingReservationsEvery(pendingSweepInterval)
 
 	router := mux.NewRouter()
 
 	// Vehicle routes
 	router.HandleFunc("/vehicles", getVehicles).Methods("GET")
 	router.HandleFunc("/vehicles/{id}", getVehicle).Methods("GET")
-	router.HandleFunc("/vehicles", createVehicle).Methods("POST")
-	router.HandleFunc("/vehicles/{id}", updateVehicle).Methods("PUT")
-	router.HandleFunc("/vehicles/{id}", deleteVehicle).Methods("DELETE")
+	router.HandleFunc("/vehicles", requireRole(createVehicle, roleFleetAdmin)).Methods("POST")
+	router.HandleFunc("/vehicles/{id}", requireRole(updateVehicle, roleFleetAdmin)).Methods("PUT")
+	router.HandleFunc("/vehicles/{id}", requireRole(deleteVehicle, roleFleetAdmin)).Methods("DELETE")
 
-	router.HandleFunc("/reservations", createReservation).Methods("POST")
-	router.HandleFunc("/reservations/{id}", updateReservationHandler).Methods("PUT")
-	router.HandleFunc("/reservations/{id}", cancelReservation).Methods("DELETE")
+	// Reservation routes require an access token issued by User_Management
+	router.HandleFunc("/reservations", requireAuth(createReservation)).Methods("POST")
+	router.HandleFunc("/reservations/{id}", requireAuth(updateReservationHandler)).Methods("PUT")
+	router.HandleFunc("/reservations/{id}", requireAuth(cancelReservation)).Methods("DELETE")
+	router.HandleFunc("/reservations/{id}/complete", requireAuth(completeReservationHandler)).Methods("POST")
+	router.HandleFunc("/reservations/{id}/confirm-deposit", requireAuth(confirmPendingReservationHandler)).Methods("POST")
 
 	router.HandleFunc("/api/v1/vehicles/available", getAvailableVehiclesHandler).Methods("GET")
 	router.HandleFunc("/api/v1/vehicles/available", getAvailableVehiclesForUserHandler).Methods("GET")
 
 	http.HandleFunc("/check-user", checkUserHandler)
 	http.HandleFunc("/check-vehicle-availability", checkVehicleAvailabilityHandler)
-	http.HandleFunc("/create-reservation", createReservationHandler)
+	http.HandleFunc("/create-reservation", requireAuth(createReservationHandler))
 
-	router.HandleFunc("/api/reservations", getReservationsByUserHandler).Methods("GET")
+	router.HandleFunc("/api/reservations", requireAuth(getReservationsByUserHandler)).Methods("GET")
 
 	// CORS handling
 	corsHandler := handlers.CORS(
-		handlers.AllowedHeaders([]string{"Content-Type"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"}),
 		handlers.AllowedOrigins([]string{"*"}), // Replace "*" with the frontend origin if known
 	)
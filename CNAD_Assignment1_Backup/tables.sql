@@ -4,22 +4,35 @@ Create table users (
     id int auto_increment primary key,
     name varchar(255) not null unique,
     email varchar(255) not null unique,
-    password varchar(255) not null,
-    membership_tier ENUM('Basic','Premium','VIP') not null
+    password varchar(255) not null, -- bcrypt hash; legacy plaintext rows are rehashed on login
+    membership_tier varchar(50) not null, -- references membership_benefits.tier
+    role ENUM('customer','fleet_admin','billing_admin','support') not null default 'customer',
+    preferred_currency CHAR(3) not null default 'SGD'  -- billed in this currency when the vehicle has a rate in it
 );    
     
 CREATE TABLE membership_benefits (
-    tier ENUM('Basic', 'Premium', 'VIP') PRIMARY KEY,
+    tier VARCHAR(50) PRIMARY KEY,         -- tiers are managed through /api/v1/memberships
     discount_rate DECIMAL(5,2) NOT NULL, -- discount in percentage (e.g., 10.00 for 10%)
     increased_limit INT NOT NULL,         -- increased booking limit for the tier
-    priority_access BOOLEAN NOT NULL      -- true/false for priority vehicle access
+    priority_access BOOLEAN NOT NULL,     -- true/false for priority vehicle access
+    booking_window_days INT NOT NULL DEFAULT 14  -- days ahead a priority tier may book; others use the general window
 );
 
-INSERT INTO membership_benefits (tier, discount_rate, increased_limit, priority_access)
+INSERT INTO membership_benefits (tier, discount_rate, increased_limit, priority_access, booking_window_days)
 VALUES
-    ('Basic', 0.05, 5, FALSE),
-    ('Premium', 0.10, 10, TRUE),
-    ('VIP', 0.15, 20, TRUE);
+    ('Basic', 5.00, 5, FALSE, 14),
+    ('Premium', 10.00, 10, TRUE, 30),
+    ('VIP', 15.00, 20, TRUE, 60);
+
+CREATE TABLE refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,  -- SHA-256 of the refresh token, never the token itself
+    expires_at DATETIME NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
 
 
 Create database vehicle_reservation_db;
@@ -28,6 +41,8 @@ Create table vehicles (
     id int auto_increment primary key,
     make varchar(255),
     model varchar(255),
+    vehicle_type varchar(50) not null default 'sedan',  -- must exist in vehicle_pricing.vehicle_type (billingpayment_db)
+    location varchar(50) not null default 'SG',  -- tax jurisdiction, looked up in tax_rates.jurisdiction (billingpayment_db)
     availability Boolean
 )
 
@@ -37,10 +52,20 @@ CREATE TABLE reservations (
     vehicle_id INT NOT NULL,
     start_time DATETIME NOT NULL,
     end_time DATETIME NOT NULL,
-    status ENUM('active', 'cancelled') DEFAULT 'active',
+    status ENUM('pending', 'active', 'cancelled', 'completed') DEFAULT 'active',  -- pending until the deposit hold is confirmed
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    cancelled_at DATETIME,                  -- when the reservation was cancelled; decides the cancellation fee
+    returned_at DATETIME,                   -- when the vehicle came back; decides the late return charge
+    quote_id TEXT,                          -- signed quote the booking was made with; cleared when rescheduled
     FOREIGN KEY (vehicle_id) REFERENCES vehicles(id),
 );
 
+-- One row per user who has booked, locked while a booking is checked against
+-- the user's membership limit so concurrent bookings are counted one at a time
+CREATE TABLE user_booking_locks (
+    user_id INT PRIMARY KEY
+);
+
 CREATE TABLE rental_history (
     id INT AUTO_INCREMENT PRIMARY KEY,
     user_id INT NOT NULL,
@@ -55,23 +80,334 @@ Create database billingpayment_db;
 
 Create table promotions (
     id int auto_increment primary key,
-    code varchar(255),
-    discount_percentage int,
-    expiration_date DATE not null
+    code varchar(255) not null unique,  -- stored upper case
+    discount_percentage int not null,
+    expiration_date DATE not null,      -- last day the code can be redeemed
+    max_uses int,                       -- NULL for unlimited redemptions
+    minimum_spend DECIMAL(10,2) not null default 0.00,
+    stackable BOOLEAN not null default false  -- applies on top of the membership discount instead of replacing it
 );
 
-Create table billing (
+Create table billings (
     id int auto_increment primary key,
-    reservation_id int not null,
+    reservation_id int not null unique,  -- a reservation is billed at most once
+    user_id int not null,
+    currency CHAR(3) not null default 'SGD',  -- ISO 4217 code of every amount on the billing
     amount DECIMAL(10,2) not null,
-    payment_status ENUM('Pending','Paid') not null
+    payment_status ENUM('Pending','Paid','PartiallyRefunded','Refunded','Void') not null,
+    cancellation_fee DECIMAL(10,2),  -- set once a cancelled reservation has been settled
+    tax_amount DECIMAL(10,2) not null default 0.00,  -- tax included in amount
+    tax_inclusive BOOLEAN not null default false,    -- true if the prices already included the tax
+    overtime_minutes int,            -- how late the vehicle was returned
+    overtime_fee DECIMAL(10,2),      -- late return charge before tax; set once the return has been assessed
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 )
 
+CREATE TABLE promotion_redemptions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    promotion_id INT NOT NULL,
+    user_id INT NOT NULL,
+    billing_id INT NOT NULL UNIQUE,         -- one promotion per billing
+    discount_amount DECIMAL(10,2) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (promotion_id, user_id),         -- each user may redeem a code once
+    FOREIGN KEY (promotion_id) REFERENCES promotions(id),
+    FOREIGN KEY (billing_id) REFERENCES billings(id)
+);
+
+-- Single row counter so invoice numbers are sequential without gaps
+CREATE TABLE invoice_sequence (
+    last_number INT NOT NULL
+);
+
+INSERT INTO invoice_sequence (last_number) VALUES (0);
+
+CREATE TABLE invoices (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    invoice_number VARCHAR(20) NOT NULL UNIQUE,  -- INV-000001, INV-000002, ...
+    billing_id INT NOT NULL UNIQUE,              -- one invoice per billing
+    reservation_id INT NOT NULL,
+    customer_name VARCHAR(255) NOT NULL,
+    customer_email VARCHAR(255) NOT NULL,
+    vehicle_make VARCHAR(255) NOT NULL,
+    vehicle_model VARCHAR(255) NOT NULL,
+    vehicle_type VARCHAR(50) NOT NULL,
+    rental_start DATETIME NOT NULL,
+    rental_end DATETIME NOT NULL,
+    currency CHAR(3) NOT NULL,                   -- of the totals and line items
+    subtotal DECIMAL(10,2) NOT NULL,
+    tax DECIMAL(10,2) NOT NULL,
+    total DECIMAL(10,2) NOT NULL,
+    issued_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (billing_id) REFERENCES billings(id)
+);
+
+CREATE TABLE invoice_line_items (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    kind ENUM('rental','discount','promotion','overtime','adjustment','fee','tax') NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    quantity DECIMAL(10,2) NOT NULL,
+    unit_price DECIMAL(10,2) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,                -- negative for discounts
+    FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+);
+
+CREATE TABLE payments (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    billing_id INT NOT NULL,
+    method ENUM('card','wallet') NOT NULL DEFAULT 'card',
+    currency CHAR(3) NOT NULL,              -- always the currency of the billing
+    amount DECIMAL(10,2) NOT NULL,
+    status ENUM('succeeded','declined','requires_action') NOT NULL,
+    gateway_reference VARCHAR(64) NOT NULL, -- wallet_<wallet transaction id> for wallet payments
+    failure_reason VARCHAR(64),
+    card_last4 CHAR(4) NOT NULL,            -- full card numbers are never stored; empty for wallet payments
+    card_token VARCHAR(64),                 -- gateway token of the card, charged again by dunning retries
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME,                  -- NULL while a 3-D Secure challenge is pending
+    FOREIGN KEY (billing_id) REFERENCES billings(id)
+);
+
+-- Unpaid billings whose card payment was declined. The card of the last
+-- declined payment is charged again at next_attempt_at, on the schedule in
+-- DUNNING_RETRY_DAYS. A user with a delinquent case on a Pending billing
+-- cannot book vehicles.
+CREATE TABLE dunning_cases (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    billing_id INT NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    status ENUM('open','exhausted','settled','closed') NOT NULL,
+    failures INT NOT NULL DEFAULT 0,        -- declined payments, the first included
+    delinquent BOOLEAN NOT NULL DEFAULT FALSE,
+    payment_id INT NOT NULL,                -- last declined payment
+    next_attempt_at DATETIME,               -- NULL once no retry is scheduled
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    closed_at DATETIME,                     -- when the billing was paid or stopped being due
+    INDEX (user_id),
+    INDEX (status, next_attempt_at),
+    FOREIGN KEY (billing_id) REFERENCES billings(id),
+    FOREIGN KEY (payment_id) REFERENCES payments(id)
+);
+
+-- Reminders to customers about unpaid billings, in the order they escalate.
+-- The notification sender delivers them from this table.
+CREATE TABLE dunning_reminders (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    case_id INT NOT NULL,
+    user_id INT NOT NULL,
+    kind ENUM('payment_failed','payment_reminder','final_notice','account_suspended') NOT NULL,
+    message VARCHAR(512) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (case_id) REFERENCES dunning_cases(id)
+);
+
+CREATE TABLE refunds (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    billing_id INT NOT NULL,
+    payment_id INT NOT NULL,                -- the succeeded payment being refunded
+    currency CHAR(3) NOT NULL,              -- always the currency of the billing
+    amount DECIMAL(10,2) NOT NULL,
+    reason_code ENUM('reservation_cancelled','service_issue','duplicate_charge','goodwill','other') NOT NULL,
+    note VARCHAR(255),
+    gateway_reference VARCHAR(64) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (billing_id) REFERENCES billings(id),
+    FOREIGN KEY (payment_id) REFERENCES payments(id)
+);
+
+-- Append-only double-entry ledger of every money movement. The lines of an
+-- entry sum to zero in each currency: debits are positive, credits negative.
+-- Customer accounts are named customer:<user id> and wallets wallet:<user id>;
+-- the others are company accounts such as revenue, tax_payable, promotions,
+-- refunds, goodwill and cash.
+-- Rows are never updated or deleted.
+CREATE TABLE ledger_entries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,                   -- customer the movement concerns
+    billing_id INT,
+    kind ENUM('charge','payment','refund','promotion','fee','adjustment','top_up','credit','deposit') NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (billing_id) REFERENCES billings(id)
+);
+
+CREATE TABLE ledger_lines (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    entry_id INT NOT NULL,
+    account VARCHAR(64) NOT NULL,
+    currency CHAR(3) NOT NULL,
+    amount DECIMAL(12,2) NOT NULL,          -- debit positive, credit negative
+    INDEX (account),
+    FOREIGN KEY (entry_id) REFERENCES ledger_entries(id)
+);
+
+-- Prepaid wallet balance of each user in each currency, changed only together
+-- with a wallet_transactions row
+CREATE TABLE wallets (
+    user_id INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    balance DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+    PRIMARY KEY (user_id, currency)
+);
+
+-- Attempts to add money to a wallet by card
+CREATE TABLE wallet_top_ups (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    status ENUM('succeeded','declined','requires_action') NOT NULL,
+    gateway_reference VARCHAR(64) NOT NULL,
+    failure_reason VARCHAR(64),
+    card_last4 CHAR(4) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME                   -- NULL while a 3-D Secure challenge is pending
+);
+
+CREATE TABLE wallet_transactions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,          -- positive when added to the wallet
+    kind ENUM('top_up','payment','refund','credit') NOT NULL,
+    billing_id INT,                         -- for payments and refunds
+    top_up_id INT,
+    note VARCHAR(255),
+    created_by INT,                         -- staff member who issued a credit
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX (user_id),
+    FOREIGN KEY (billing_id) REFERENCES billings(id),
+    FOREIGN KEY (top_up_id) REFERENCES wallet_top_ups(id)
+);
+
+-- Monthly account statements, one per user, period and currency. The balance
+-- is what the user owes; refunds and wallet credits are listed for information
+-- and do not change it.
+CREATE TABLE statements (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    period CHAR(7) NOT NULL,                -- YYYY-MM
+    currency CHAR(3) NOT NULL,
+    opening_balance DECIMAL(10,2) NOT NULL,
+    charges DECIMAL(10,2) NOT NULL,
+    payments DECIMAL(10,2) NOT NULL,
+    refunds DECIMAL(10,2) NOT NULL,
+    credits DECIMAL(10,2) NOT NULL,
+    closing_balance DECIMAL(10,2) NOT NULL,
+    generated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (user_id, period, currency)
+);
+
+-- Security deposits authorized on the customer's card when a reservation of a
+-- vehicle type with a deposit is created. Holds still open at release_after
+-- (the reservation end plus DEPOSIT_RELEASE_HOURS) are released automatically.
+CREATE TABLE deposit_holds (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    reservation_id INT NOT NULL,
+    user_id INT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    captured_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+    status ENUM('requires_action','authorized','declined','captured','released') NOT NULL,
+    gateway_reference VARCHAR(64) NOT NULL,
+    failure_reason VARCHAR(64),
+    card_last4 CHAR(4) NOT NULL,
+    capture_note VARCHAR(255),              -- what the captured amount was kept for
+    release_after DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    closed_at DATETIME,                     -- when it was declined, captured or released
+    INDEX (reservation_id),
+    INDEX (status, release_after)
+);
+
+-- One row per reservation, locked while a deposit hold is placed for it
+CREATE TABLE deposit_hold_locks (
+    reservation_id INT PRIMARY KEY
+);
+
 CREATE TABLE vehicle_pricing (
     id INT AUTO_INCREMENT PRIMARY KEY,
     vehicle_type VARCHAR(50) NOT NULL,
+    currency CHAR(3) NOT NULL DEFAULT 'SGD',  -- every vehicle type needs a rate in BILLING_CURRENCY
     base_rate_per_hour DECIMAL(10, 2) NOT NULL,
-    discount_basic DECIMAL(5, 2) DEFAULT 0.00,  -- Percentage discount for Basic members
-    discount_premium DECIMAL(5, 2) DEFAULT 10.00,  -- Percentage discount for Premium members
-    discount_vip DECIMAL(5, 2) DEFAULT 20.00  -- Percentage discount for VIP members
+    deposit DECIMAL(10, 2) NOT NULL DEFAULT 0.00,  -- Security deposit held on the card; 0 for none
+    UNIQUE (vehicle_type, currency)
+);
+
+INSERT INTO vehicle_pricing (vehicle_type, currency, base_rate_per_hour, deposit)
+VALUES
+    ('compact', 'SGD', 8.00, 0.00),
+    ('sedan', 'SGD', 10.00, 0.00),
+    ('SUV', 'SGD', 14.00, 300.00),
+    ('EV', 'SGD', 12.00, 500.00),
+    ('van', 'SGD', 16.00, 300.00),
+    ('compact', 'MYR', 25.00, 0.00),
+    ('sedan', 'MYR', 32.00, 0.00),
+    ('SUV', 'MYR', 45.00, 950.00),
+    ('EV', 'MYR', 38.00, 1600.00),
+    ('van', 'MYR', 50.00, 950.00);
+
+-- Exchange rates used to convert amounts for reports and minimum spends. One
+-- unit of from_currency is worth rate units of to_currency; the opposite
+-- direction uses the inverse when it has no row of its own. Loaded from
+-- EXCHANGE_RATES_FILE or POST /exchange-rates.
+CREATE TABLE exchange_rates (
+    from_currency CHAR(3) NOT NULL,
+    to_currency CHAR(3) NOT NULL,
+    rate DECIMAL(18, 8) NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (from_currency, to_currency)
 );
+
+-- Fee charged when a reservation is cancelled with less than hours_before_start
+-- hours of notice; the highest matching fee applies. Rows with a NULL tier are
+-- the default policy for tiers without their own rows.
+CREATE TABLE cancellation_policies (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    membership_tier VARCHAR(50),
+    hours_before_start DECIMAL(6, 2) NOT NULL,
+    fee_percentage DECIMAL(5, 2) NOT NULL
+);
+
+INSERT INTO cancellation_policies (membership_tier, hours_before_start, fee_percentage)
+VALUES
+    (NULL, 24, 25.00),
+    (NULL, 6, 50.00),
+    (NULL, 0, 100.00),
+    ('Premium', 12, 25.00),
+    ('Premium', 3, 50.00),
+    ('Premium', 0, 100.00),
+    ('VIP', 1, 25.00),
+    ('VIP', 0, 100.00);
+
+-- Charge for returning a vehicle after the reservation's end_time. Returns
+-- within grace_minutes are free; later ones pay for all of the overtime at
+-- rate_percentage of the vehicle's hourly base rate. The row with a NULL tier
+-- is the default.
+CREATE TABLE late_return_policies (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    membership_tier VARCHAR(50) UNIQUE,
+    grace_minutes INT NOT NULL DEFAULT 0,
+    rate_percentage DECIMAL(6, 2) NOT NULL
+);
+
+INSERT INTO late_return_policies (membership_tier, grace_minutes, rate_percentage)
+VALUES
+    (NULL, 15, 150.00),
+    ('Premium', 30, 125.00),
+    ('VIP', 60, 100.00);
+
+-- Tax charged on rentals in each jurisdiction (vehicles.location). Exclusive
+-- rates are added on top of the price; inclusive rates are already part of it.
+CREATE TABLE tax_rates (
+    jurisdiction VARCHAR(50) PRIMARY KEY,
+    tax_name VARCHAR(50) NOT NULL,          -- printed on quotes and invoices, e.g. GST
+    rate DECIMAL(5, 2) NOT NULL,            -- percentage
+    pricing_mode ENUM('exclusive','inclusive') NOT NULL DEFAULT 'exclusive'
+);
+
+INSERT INTO tax_rates (jurisdiction, tax_name, rate, pricing_mode)
+VALUES
+    ('SG', 'GST', 9.00, 'exclusive'),
+    ('MY', 'SST', 8.00, 'inclusive');